@@ -0,0 +1,367 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flamego/flamego"
+	"github.com/google/go-github/v45/github"
+	"github.com/pkg/errors"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/codenotify/codenotify.run/internal/conf"
+	"github.com/codenotify/codenotify.run/internal/queue"
+	"github.com/codenotify/codenotify.run/internal/rundb"
+)
+
+const (
+	// defaultAPIListLimit is the default number of items returned by list
+	// endpoints of the admin API.
+	defaultAPIListLimit = 50
+	// maxAPIListLimit is the maximum number of items returned by list endpoints
+	// of the admin API.
+	maxAPIListLimit = 500
+)
+
+// jobEventAdminAPI is the event of jobs that are enqueued via the admin API,
+// rather than webhook deliveries.
+const jobEventAdminAPI = "admin_api"
+
+// rerunPayload is the payload of jobs that re-run Codenotify on a pull request
+// via the admin API.
+type rerunPayload struct {
+	// Action is always "rerun".
+	Action       string               `json:"action"`
+	Installation *github.Installation `json:"installation"`
+	Repo         *github.Repository   `json:"repository"`
+	Number       int                  `json:"number"`
+}
+
+// apiJSON returns the JSON response of the admin API.
+func apiJSON(c flamego.Context, status int, v any) (int, []byte) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Error("Failed to encode API response: %v", err)
+		status, data = http.StatusInternalServerError, []byte(`{"error":"Failed to encode response"}`)
+	}
+	c.ResponseWriter().Header().Set("Content-Type", "application/json; charset=utf-8")
+	return status, data
+}
+
+// apiError returns the JSON error response of the admin API.
+func apiError(c flamego.Context, status int, message string) (int, []byte) {
+	return apiJSON(c, status, map[string]string{"error": message})
+}
+
+// apiAuth returns the middleware that authenticates requests to the admin API
+// with the "Authorization: Bearer <token>" header.
+func apiAuth(token string) flamego.Handler {
+	return func(c flamego.Context) {
+		got, ok := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			return
+		}
+
+		// NOTE: Writing the response stops the rest of handlers.
+		status, data := apiError(c, http.StatusUnauthorized, "Invalid or missing admin token")
+		c.ResponseWriter().WriteHeader(status)
+		_, _ = c.ResponseWriter().Write(data)
+	}
+}
+
+// apiRun is a run in responses of the admin API.
+type apiRun struct {
+	ID             string              `json:"id"`
+	Repository     string              `json:"repository"`
+	RepositoryID   int64               `json:"repository_id"`
+	InstallationID int64               `json:"installation_id"`
+	PullRequest    int                 `json:"pull_request"`
+	BaseSHA        string              `json:"base_sha"`
+	HeadSHA        string              `json:"head_sha"`
+	Trigger        string              `json:"trigger"`
+	State          string              `json:"state"`
+	StartedAt      time.Time           `json:"started_at"`
+	DurationMs     int64               `json:"duration_ms"`
+	Error          string              `json:"error,omitempty"`
+	Subscribers    map[string][]string `json:"subscribers"`
+	// LogURL is the URL of the run page, it is empty when the run has no log.
+	LogURL string `json:"log_url,omitempty"`
+}
+
+func newAPIRun(config *conf.Config, run *rundb.Run) *apiRun {
+	r := &apiRun{
+		ID:             run.ID,
+		Repository:     run.Repository,
+		RepositoryID:   run.RepositoryID,
+		InstallationID: run.InstallationID,
+		PullRequest:    run.PullRequest,
+		BaseSHA:        run.BaseSHA,
+		HeadSHA:        run.HeadSHA,
+		Trigger:        run.Trigger,
+		State:          run.State,
+		StartedAt:      run.StartedAt,
+		DurationMs:     run.Duration.Milliseconds(),
+		Error:          run.Error,
+		Subscribers:    run.Subscribers,
+	}
+	if r.Subscribers == nil {
+		r.Subscribers = map[string][]string{}
+	}
+	// Codenotify does not run with an invalid configuration file, thus no log.
+	if run.State != string(runStateInvalidConfig) {
+		r.LogURL = fmt.Sprintf("%s/runs/%s", config.Server.ExternalURL, run.ID)
+	}
+	return r
+}
+
+// handleAPIListRuns returns the handler that lists runs from the newest to the
+// oldest, which can be filtered by "repository", "pull_request", "state",
+// "since" and "until" (in RFC 3339), and limited by "limit".
+func handleAPIListRuns(config *conf.Config, db *rundb.DB) flamego.Handler {
+	return func(c flamego.Context) (int, []byte) {
+		opts := rundb.ListRunsOptions{
+			Repository: c.Query("repository"),
+			State:      c.Query("state"),
+			Limit:      defaultAPIListLimit,
+		}
+
+		var err error
+		if v := c.Query("pull_request"); v != "" {
+			opts.PullRequest, err = strconv.Atoi(v)
+			if err != nil || opts.PullRequest <= 0 {
+				return apiError(c, http.StatusBadRequest, `"pull_request" must be a positive integer`)
+			}
+		}
+		if v := c.Query("since"); v != "" {
+			opts.Since, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				return apiError(c, http.StatusBadRequest, `"since" must be in RFC 3339 format`)
+			}
+		}
+		if v := c.Query("until"); v != "" {
+			opts.Until, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				return apiError(c, http.StatusBadRequest, `"until" must be in RFC 3339 format`)
+			}
+		}
+		if v := c.Query("limit"); v != "" {
+			opts.Limit, err = strconv.Atoi(v)
+			if err != nil || opts.Limit <= 0 || opts.Limit > maxAPIListLimit {
+				return apiError(c, http.StatusBadRequest, fmt.Sprintf(`"limit" must be between 1 and %d`, maxAPIListLimit))
+			}
+		}
+
+		runs, err := db.ListRuns(c.Request().Context(), opts)
+		if err != nil {
+			log.Error("Failed to list runs: %v", err)
+			return apiError(c, http.StatusInternalServerError, "Failed to list runs")
+		}
+
+		resp := make([]*apiRun, 0, len(runs))
+		for _, run := range runs {
+			resp = append(resp, newAPIRun(config, run))
+		}
+		return apiJSON(c, http.StatusOK, resp)
+	}
+}
+
+// handleAPIGetRun returns the handler that returns the run.
+func handleAPIGetRun(config *conf.Config, db *rundb.DB) flamego.Handler {
+	return func(c flamego.Context) (int, []byte) {
+		run, err := db.GetRun(c.Request().Context(), c.Param("runID"))
+		if err == rundb.ErrNotExist {
+			return apiError(c, http.StatusNotFound, "Run not found")
+		} else if err != nil {
+			log.Error("Failed to get run %q: %v", c.Param("runID"), err)
+			return apiError(c, http.StatusInternalServerError, "Failed to get run")
+		}
+		return apiJSON(c, http.StatusOK, newAPIRun(config, run))
+	}
+}
+
+// errNotFound is returned when the requested GitHub resource does not exist or
+// is not accessible by the GitHub App.
+var errNotFound = errors.New("not found")
+
+// pullRequestFinder returns the name of the GitHub App, the installation and
+// the repository of the pull request. It returns errNotFound when the pull
+// request does not exist or no GitHub App is installed on the repository.
+type pullRequestFinder func(ctx context.Context, owner, repo string, number int) (string, *github.Installation, *github.Repository, error)
+
+// findPullRequest returns the pullRequestFinder that looks up pull requests
+// with the first GitHub App that is installed on the repository.
+func findPullRequest(apps githubApps) pullRequestFinder {
+	return func(ctx context.Context, owner, repo string, number int) (string, *github.Installation, *github.Repository, error) {
+		for _, app := range apps {
+			appClient, err := newAppClient(app)
+			if err != nil {
+				return "", nil, nil, errors.Wrapf(err, "new app client of %q", app.Name)
+			}
+			installation, resp, err := appClient.Apps.FindRepositoryInstallation(ctx, owner, repo)
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				continue
+			} else if err != nil {
+				return "", nil, nil, errors.Wrapf(err, "find repository installation of %q", app.Name)
+			}
+
+			client, _, err := newGitHubClient(ctx, app, installation.GetID())
+			if err != nil {
+				return "", nil, nil, errors.Wrap(err, "create GitHub client")
+			}
+			repository, _, err := client.Repositories.Get(ctx, owner, repo)
+			if err != nil {
+				return "", nil, nil, errors.Wrap(err, "get repository")
+			}
+			_, resp, err = client.PullRequests.Get(ctx, owner, repo, number)
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				return "", nil, nil, errNotFound
+			} else if err != nil {
+				return "", nil, nil, errors.Wrap(err, "get pull request")
+			}
+			return app.Name, installation, repository, nil
+		}
+		return "", nil, nil, errNotFound
+	}
+}
+
+// handleAPIRerun returns the handler that enqueues a job to run Codenotify
+// again on the pull request, which supersedes the in-flight run of the same
+// pull request if any.
+func handleAPIRerun(q *queue.Queue, runs *runRegistry, findPullRequest pullRequestFinder) flamego.Handler {
+	return func(c flamego.Context) (int, []byte) {
+		number, err := strconv.Atoi(c.Param("number"))
+		if err != nil || number <= 0 {
+			return apiError(c, http.StatusBadRequest, "Invalid pull request number")
+		}
+
+		owner, repo := c.Param("owner"), c.Param("repo")
+		app, installation, repository, err := findPullRequest(c.Request().Context(), owner, repo, number)
+		if err == errNotFound {
+			return apiError(c, http.StatusNotFound, "Pull request not found or the GitHub App is not installed on the repository")
+		} else if err != nil {
+			log.Error("Failed to find pull request %s/%s#%d: %v", owner, repo, number, err)
+			return apiError(c, http.StatusInternalServerError, "Failed to find pull request")
+		}
+
+		payload, err := json.Marshal(
+			&rerunPayload{
+				Action:       "rerun",
+				Installation: installation,
+				Repo:         repository,
+				Number:       number,
+			},
+		)
+		if err != nil {
+			log.Error("Failed to encode payload: %v", err)
+			return apiError(c, http.StatusInternalServerError, "Failed to encode payload")
+		}
+		job, err := q.Enqueue(app, "", jobEventAdminAPI, installation.GetID(), payload)
+		if err != nil {
+			log.Error("Failed to enqueue job: %v", err)
+			return apiError(c, http.StatusInternalServerError, "Failed to enqueue job")
+		}
+		log.Trace("Enqueued job %s to rerun pull request %s#%d", job.ID, repository.GetFullName(), number)
+
+		runs.supersede(
+			pullRequestKey(
+				&github.PullRequestEvent{
+					Repo:        repository,
+					PullRequest: &github.PullRequest{Number: github.Int(number)},
+				},
+			),
+			job.ID,
+		)
+		return apiJSON(c, http.StatusAccepted, map[string]string{"job_id": job.ID})
+	}
+}
+
+// installationLister returns all installations of the GitHub Apps.
+type installationLister func(ctx context.Context) ([]*github.Installation, error)
+
+// listInstallations returns the installationLister that lists installations
+// of all the GitHub Apps.
+func listInstallations(apps githubApps) installationLister {
+	return func(ctx context.Context) ([]*github.Installation, error) {
+		var installations []*github.Installation
+		for _, app := range apps {
+			client, err := newAppClient(app)
+			if err != nil {
+				return nil, errors.Wrapf(err, "new app client of %q", app.Name)
+			}
+
+			opts := &github.ListOptions{PerPage: 100}
+			for {
+				page, resp, err := client.Apps.ListInstallations(ctx, opts)
+				if err != nil {
+					return nil, errors.Wrapf(err, "list installations of %q", app.Name)
+				}
+				installations = append(installations, page...)
+				if resp.NextPage == 0 {
+					break
+				}
+				opts.Page = resp.NextPage
+			}
+		}
+		return installations, nil
+	}
+}
+
+// apiInstallation is an installation in responses of the admin API.
+type apiInstallation struct {
+	ID          int64      `json:"id"`
+	AppID       int64      `json:"app_id"`
+	Account     string     `json:"account"`
+	AccountType string     `json:"account_type"`
+	CreatedAt   time.Time  `json:"created_at"`
+	SuspendedAt *time.Time `json:"suspended_at,omitempty"`
+	// LastActivityAt is the start time of the latest run, it is absent when
+	// there is no run of the installation.
+	LastActivityAt *time.Time `json:"last_activity_at,omitempty"`
+}
+
+// handleAPIListInstallations returns the handler that lists installations of
+// the GitHub Apps with their last activities.
+func handleAPIListInstallations(db *rundb.DB, listInstallations installationLister) flamego.Handler {
+	return func(c flamego.Context) (int, []byte) {
+		ctx := c.Request().Context()
+		installations, err := listInstallations(ctx)
+		if err != nil {
+			log.Error("Failed to list installations: %v", err)
+			return apiError(c, http.StatusInternalServerError, "Failed to list installations")
+		}
+		activities, err := db.LastActivities(ctx)
+		if err != nil {
+			log.Error("Failed to get last activities: %v", err)
+			return apiError(c, http.StatusInternalServerError, "Failed to get last activities")
+		}
+
+		resp := make([]*apiInstallation, 0, len(installations))
+		for _, installation := range installations {
+			i := &apiInstallation{
+				ID:          installation.GetID(),
+				AppID:       installation.GetAppID(),
+				Account:     installation.GetAccount().GetLogin(),
+				AccountType: installation.GetTargetType(),
+				CreatedAt:   installation.GetCreatedAt().Time,
+			}
+			if installation.SuspendedAt != nil {
+				i.SuspendedAt = &installation.SuspendedAt.Time
+			}
+			if at, ok := activities[installation.GetID()]; ok {
+				i.LastActivityAt = &at
+			}
+			resp = append(resp, i)
+		}
+		return apiJSON(c, http.StatusOK, resp)
+	}
+}
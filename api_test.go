@@ -0,0 +1,205 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flamego/flamego"
+	"github.com/google/go-github/v45/github"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codenotify/codenotify.run/internal/conf"
+	"github.com/codenotify/codenotify.run/internal/queue"
+	"github.com/codenotify/codenotify.run/internal/rundb"
+	"github.com/codenotify/codenotify.run/internal/runlog"
+)
+
+func TestAdminAPI(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db, err := rundb.Open(ctx, rundb.TypeSQLite, filepath.Join(dir, "codenotify.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	q, err := queue.Open(filepath.Join(dir, "queue.db"), time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = q.Close() })
+
+	startedAt := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	run1 := &rundb.Run{
+		ID:             runlog.NewID().String(),
+		Repository:     "codenotify/codenotify.run",
+		InstallationID: 1,
+		PullRequest:    1234,
+		State:          string(runStateSuccess),
+		StartedAt:      startedAt,
+		Duration:       1500 * time.Millisecond,
+		Subscribers:    map[string][]string{"@alice": {"main.go"}},
+	}
+	require.NoError(t, db.CreateRun(ctx, run1))
+	run2 := &rundb.Run{
+		ID:             runlog.NewID().String(),
+		Repository:     "codenotify/other",
+		InstallationID: 1,
+		PullRequest:    1,
+		State:          string(runStateInvalidConfig),
+		StartedAt:      startedAt.Add(time.Hour),
+	}
+	require.NoError(t, db.CreateRun(ctx, run2))
+
+	var config conf.Config
+	config.Server.ExternalURL = "https://codenotify.run"
+	findPullRequest := func(_ context.Context, owner, repo string, number int) (string, *github.Installation, *github.Repository, error) {
+		if owner != "codenotify" || repo != "codenotify.run" || number != 1234 {
+			return "", nil, nil, errNotFound
+		}
+		return "internal",
+			&github.Installation{ID: github.Int64(1)},
+			&github.Repository{FullName: github.String("codenotify/codenotify.run")},
+			nil
+	}
+	listInstallations := func(context.Context) ([]*github.Installation, error) {
+		return []*github.Installation{
+			{
+				ID:         github.Int64(1),
+				AppID:      github.Int64(1),
+				Account:    &github.User{Login: github.String("codenotify")},
+				TargetType: github.String("Organization"),
+				CreatedAt:  &github.Timestamp{Time: startedAt.Add(-time.Hour)},
+			},
+			{
+				ID:         github.Int64(2),
+				AppID:      github.Int64(2),
+				Account:    &github.User{Login: github.String("unknwon")},
+				TargetType: github.String("User"),
+				CreatedAt:  &github.Timestamp{Time: startedAt.Add(-time.Hour)},
+			},
+		}, nil
+	}
+
+	f := flamego.New()
+	f.Group("/api/v1", func() {
+		f.Get("/runs", handleAPIListRuns(&config, db))
+		f.Get("/runs/{runID}", handleAPIGetRun(&config, db))
+		f.Post("/repos/{owner}/{repo}/pulls/{number}/rerun", handleAPIRerun(q, newRunRegistry(), findPullRequest))
+		f.Get("/installations", handleAPIListInstallations(db, listInstallations))
+	}, apiAuth("admin-token"))
+
+	do := func(t *testing.T, method, path, token string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(method, path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		f.ServeHTTP(resp, req)
+		return resp
+	}
+	listRuns := func(t *testing.T, path string) []*apiRun {
+		resp := do(t, http.MethodGet, path, "admin-token")
+		require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+		var runs []*apiRun
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &runs))
+		return runs
+	}
+
+	t.Run("unauthorized", func(t *testing.T) {
+		for _, token := range []string{"", "wrong-token"} {
+			resp := do(t, http.MethodGet, "/api/v1/runs", token)
+			assert.Equal(t, http.StatusUnauthorized, resp.Code)
+			assert.JSONEq(t, `{"error":"Invalid or missing admin token"}`, resp.Body.String())
+		}
+	})
+
+	t.Run("list runs", func(t *testing.T) {
+		runs := listRuns(t, "/api/v1/runs")
+		require.Len(t, runs, 2)
+		assert.Equal(t, run2.ID, runs[0].ID)
+		assert.Empty(t, runs[0].LogURL, "invalid configuration has no log")
+		assert.Equal(t, run1.ID, runs[1].ID)
+		assert.Equal(t, int64(1500), runs[1].DurationMs)
+		assert.Equal(t, "https://codenotify.run/runs/"+run1.ID, runs[1].LogURL)
+		assert.Equal(t, map[string][]string{"@alice": {"main.go"}}, runs[1].Subscribers)
+
+		runs = listRuns(t, "/api/v1/runs?repository=codenotify/codenotify.run&pull_request=1234")
+		require.Len(t, runs, 1)
+		assert.Equal(t, run1.ID, runs[0].ID)
+
+		runs = listRuns(t, "/api/v1/runs?state=invalid_config")
+		require.Len(t, runs, 1)
+		assert.Equal(t, run2.ID, runs[0].ID)
+
+		runs = listRuns(t, "/api/v1/runs?since=2022-08-01T12:30:00Z")
+		require.Len(t, runs, 1)
+		assert.Equal(t, run2.ID, runs[0].ID)
+
+		runs = listRuns(t, "/api/v1/runs?until=2022-08-01T12:30:00Z&limit=1")
+		require.Len(t, runs, 1)
+		assert.Equal(t, run1.ID, runs[0].ID)
+
+		for _, query := range []string{"pull_request=abc", "since=yesterday", "until=2022-08-01", "limit=0", "limit=501"} {
+			resp := do(t, http.MethodGet, "/api/v1/runs?"+query, "admin-token")
+			assert.Equal(t, http.StatusBadRequest, resp.Code, query)
+		}
+	})
+
+	t.Run("get run", func(t *testing.T) {
+		resp := do(t, http.MethodGet, "/api/v1/runs/"+run1.ID, "admin-token")
+		require.Equal(t, http.StatusOK, resp.Code)
+		var run apiRun
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &run))
+		assert.Equal(t, run1.ID, run.ID)
+		assert.Equal(t, 1234, run.PullRequest)
+
+		resp = do(t, http.MethodGet, "/api/v1/runs/"+runlog.NewID().String(), "admin-token")
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+
+	t.Run("rerun", func(t *testing.T) {
+		resp := do(t, http.MethodPost, "/api/v1/repos/codenotify/codenotify.run/pulls/1234/rerun", "admin-token")
+		require.Equal(t, http.StatusAccepted, resp.Code, resp.Body.String())
+		var got map[string]string
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &got))
+
+		job, err := q.Claim(func(int64) bool { return true })
+		require.NoError(t, err)
+		require.NotNil(t, job)
+		assert.Equal(t, got["job_id"], job.ID)
+		assert.Equal(t, jobEventAdminAPI, job.Event)
+		assert.Equal(t, "internal", job.App)
+		assert.Equal(t, int64(1), job.InstallationID)
+		assert.Equal(t, "admin_api.rerun", jobTrigger(job))
+		var payload rerunPayload
+		require.NoError(t, json.Unmarshal(job.Payload, &payload))
+		assert.Equal(t, 1234, payload.Number)
+		assert.Equal(t, "codenotify/codenotify.run", payload.Repo.GetFullName())
+
+		resp = do(t, http.MethodPost, "/api/v1/repos/codenotify/codenotify.run/pulls/1/rerun", "admin-token")
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+		resp = do(t, http.MethodPost, "/api/v1/repos/codenotify/codenotify.run/pulls/abc/rerun", "admin-token")
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+
+	t.Run("list installations", func(t *testing.T) {
+		resp := do(t, http.MethodGet, "/api/v1/installations", "admin-token")
+		require.Equal(t, http.StatusOK, resp.Code)
+		var installations []*apiInstallation
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &installations))
+		require.Len(t, installations, 2)
+		assert.Equal(t, "codenotify", installations[0].Account)
+		require.NotNil(t, installations[0].LastActivityAt)
+		assert.Equal(t, run2.StartedAt, *installations[0].LastActivityAt)
+		assert.Equal(t, "unknwon", installations[1].Account)
+		assert.Equal(t, int64(2), installations[1].AppID)
+		assert.Nil(t, installations[1].LastActivityAt)
+	})
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"golang.org/x/oauth2"
+
+	"github.com/codenotify/codenotify.run/internal/conf"
+)
+
+// githubApp is a GitHub App served by the server, along with the cached access
+// tokens of its installations.
+type githubApp struct {
+	*conf.GitHubApp
+	tokens *tokenCache
+	// oauth is the OAuth configuration to identify viewers of run logs of the
+	// app, it is nil if the OAuth credentials are not configured.
+	oauth *oauth2.Config
+}
+
+// githubApps is the list of GitHub Apps served by the server, where the first
+// one is the default app.
+type githubApps []*githubApp
+
+// newGitHubApps returns the GitHub Apps of the configuration.
+func newGitHubApps(config *conf.Config) githubApps {
+	apps := make(githubApps, 0, len(config.GitHubApps))
+	for _, c := range config.GitHubApps {
+		app := &githubApp{GitHubApp: c}
+		app.tokens = newTokenCache(createInstallationToken(app))
+		app.oauth = newOAuthConfig(config, app)
+		apps = append(apps, app)
+	}
+	return apps
+}
+
+// get returns the GitHub App with the given name, where an empty name means the
+// default app, e.g. jobs enqueued before multiple apps were supported. It
+// returns nil if no such app.
+func (apps githubApps) get(name string) *githubApp {
+	if name == "" {
+		name = conf.DefaultGitHubApp
+	}
+	for _, app := range apps {
+		if app.Name == name {
+			return app
+		}
+	}
+	return nil
+}
+
+// forWebhook returns the GitHub App that the webhook event is delivered for,
+// which is determined by the webhook path of the app, then the
+// "X-GitHub-Hook-Installation-Target-ID" header, and falls back to the default
+// app.
+func (apps githubApps) forWebhook(r *http.Request) *githubApp {
+	for _, app := range apps {
+		if app.WebhookPath != "" && app.WebhookPath == r.URL.Path {
+			return app
+		}
+	}
+
+	if r.Header.Get("X-GitHub-Hook-Installation-Target-Type") == "integration" {
+		appID, err := strconv.ParseInt(r.Header.Get("X-GitHub-Hook-Installation-Target-ID"), 10, 64)
+		if err == nil {
+			for _, app := range apps {
+				if app.AppID == appID {
+					return app
+				}
+			}
+		}
+	}
+	return apps[0]
+}
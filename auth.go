@@ -0,0 +1,221 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/flamego/flamego"
+	"github.com/flamego/session"
+	"github.com/flamego/session/postgres"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	githuboauth "golang.org/x/oauth2/github"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/codenotify/codenotify.run/internal/conf"
+	"github.com/codenotify/codenotify.run/internal/runlog"
+)
+
+// The keys of session data.
+const (
+	sessionKeyAdmin      = "admin"
+	sessionKeyOAuthApp   = "oauthApp"
+	sessionKeyOAuthState = "oauthState"
+	sessionKeyOAuthToken = "oauthToken"
+	sessionKeyRedirectTo = "redirectTo"
+)
+
+// oauthTokenKey returns the session key of the OAuth token of the user for the
+// GitHub App, because GitHub Apps may be on different GitHub hosts.
+func oauthTokenKey(app *githubApp) string {
+	return sessionKeyOAuthToken + "." + app.Name
+}
+
+// newSessioner returns the middleware that injects session.Session into
+// requests. Sessions are stored in the PostgreSQL database of run history, or
+// in files next to the SQLite database, so that they are shared by replicas and
+// survive restarts, e.g. the OAuth callback may reach another replica than the
+// login.
+func newSessioner(config *conf.Config) (flamego.Handler, error) {
+	opts := session.Options{
+		Cookie: session.CookieOptions{
+			Name:     "codenotify_session",
+			Secure:   strings.HasPrefix(config.Server.ExternalURL, "https://"),
+			HTTPOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		ErrorFunc: func(err error) {
+			log.Error("Failed to collect expired sessions: %v", err)
+		},
+	}
+	switch config.Database.Type {
+	case conf.DatabasePostgres:
+		// NOTE: The table is created by migrations of the database.
+		opts.Initer = postgres.Initer()
+		opts.Config = postgres.Config{
+			DSN: config.Database.DSN,
+		}
+	default:
+		rootDir := filepath.Join(filepath.Dir(config.Database.Path), "sessions")
+		err := os.MkdirAll(rootDir, os.ModePerm)
+		if err != nil {
+			return nil, errors.Wrap(err, "create directory")
+		}
+		opts.Initer = session.FileIniter()
+		opts.Config = session.FileConfig{
+			RootDir: rootDir,
+		}
+	}
+	return session.Sessioner(opts), nil
+}
+
+// newOAuthConfig returns the OAuth configuration of the GitHub App, which is
+// used to identify viewers of run logs of private repositories. It returns nil
+// if the OAuth credentials are not configured.
+func newOAuthConfig(config *conf.Config, app *githubApp) *oauth2.Config {
+	if app.ClientID == "" || app.ClientSecret == "" {
+		return nil
+	}
+	return &oauth2.Config{
+		ClientID:     app.ClientID,
+		ClientSecret: app.ClientSecret,
+		Endpoint:     oauthEndpoint(app),
+		RedirectURL:  config.Server.ExternalURL + "/-/oauth/callback",
+	}
+}
+
+// oauthEndpoint returns the OAuth endpoint of GitHub.com or GitHub Enterprise
+// Server.
+func oauthEndpoint(app *githubApp) oauth2.Endpoint {
+	if app.APIURL == "" {
+		return githuboauth.Endpoint
+	}
+	webURL := githubWebURL(app)
+	return oauth2.Endpoint{
+		AuthURL:  webURL + "/login/oauth/authorize",
+		TokenURL: webURL + "/login/oauth/access_token",
+	}
+}
+
+// loginURL returns the URL to log in with the GitHub App and then redirect to
+// the given path.
+func loginURL(app *githubApp, redirectTo string) string {
+	return "/-/oauth/login?app=" + url.QueryEscape(app.Name) + "&redirect_to=" + url.QueryEscape(redirectTo)
+}
+
+// safeRedirectTo returns the path if it is a local path, or "/" otherwise, to
+// prevent open redirects.
+func safeRedirectTo(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+// handleOAuthLogin returns the handler that redirects the user to GitHub for
+// authorization with the GitHub App of the "app" query parameter, which
+// defaults to the default app.
+func handleOAuthLogin(apps githubApps) flamego.Handler {
+	return func(c flamego.Context, sess session.Session) (int, string) {
+		app := apps.get(c.Query("app"))
+		if app == nil || app.oauth == nil {
+			return http.StatusNotFound, "GitHub OAuth is not configured"
+		}
+
+		state := make([]byte, 16)
+		_, err := rand.Read(state)
+		if err != nil {
+			log.Error("Failed to generate OAuth state: %v", err)
+			return http.StatusInternalServerError, "Failed to generate OAuth state"
+		}
+
+		sess.Set(sessionKeyOAuthApp, app.Name)
+		sess.Set(sessionKeyOAuthState, hex.EncodeToString(state))
+		sess.Set(sessionKeyRedirectTo, safeRedirectTo(c.Query("redirect_to")))
+		c.Redirect(app.oauth.AuthCodeURL(hex.EncodeToString(state)))
+		return http.StatusFound, ""
+	}
+}
+
+// handleOAuthCallback returns the handler that completes the authorization and
+// saves the access token of the user for the GitHub App in the session.
+func handleOAuthCallback(apps githubApps) flamego.Handler {
+	return func(c flamego.Context, sess session.Session) (int, string) {
+		appName, _ := sess.Get(sessionKeyOAuthApp).(string)
+		sess.Delete(sessionKeyOAuthApp)
+		state, _ := sess.Get(sessionKeyOAuthState).(string)
+		sess.Delete(sessionKeyOAuthState)
+		if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+			return http.StatusBadRequest, "Mismatched OAuth state"
+		}
+
+		app := apps.get(appName)
+		if app == nil || app.oauth == nil {
+			return http.StatusNotFound, "GitHub OAuth is not configured"
+		}
+
+		token, err := app.oauth.Exchange(c.Request().Context(), c.Query("code"))
+		if err != nil {
+			log.Error("Failed to exchange OAuth code: %v", err)
+			return http.StatusBadRequest, "Failed to exchange OAuth code"
+		}
+		sess.Set(oauthTokenKey(app), token.AccessToken)
+
+		redirectTo, _ := sess.Get(sessionKeyRedirectTo).(string)
+		sess.Delete(sessionKeyRedirectTo)
+		c.Redirect(safeRedirectTo(redirectTo))
+		return http.StatusFound, ""
+	}
+}
+
+// errBadOAuthToken is returned when the OAuth token of the user is no longer
+// valid, e.g. expired or revoked.
+var errBadOAuthToken = errors.New("bad OAuth token")
+
+// repoAccessChecker returns true if the user of the OAuth token of the GitHub
+// App has read access to the repository of the run.
+type repoAccessChecker func(ctx context.Context, app *githubApp, token string, meta *runlog.Metadata) (bool, error)
+
+// checkRepoAccess checks read access to the repository with the GitHub API of
+// the GitHub App, which implements repoAccessChecker.
+func checkRepoAccess(ctx context.Context, app *githubApp, token string, meta *runlog.Metadata) (bool, error) {
+	client, err := newAPIClient(
+		app,
+		oauth2.NewClient(
+			ctx,
+			oauth2.StaticTokenSource(
+				&oauth2.Token{
+					AccessToken: token,
+				},
+			),
+		),
+	)
+	if err != nil {
+		return false, errors.Wrap(err, "new API client")
+	}
+
+	repo, resp, err := client.Repositories.GetByID(ctx, meta.RepositoryID)
+	if resp != nil {
+		switch resp.StatusCode {
+		case http.StatusUnauthorized:
+			return false, errBadOAuthToken
+		case http.StatusForbidden, http.StatusNotFound:
+			return false, nil
+		}
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "get repository")
+	}
+	return repo.GetPermissions()["pull"], nil
+}
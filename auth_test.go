@@ -0,0 +1,157 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flamego/flamego"
+	"github.com/flamego/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codenotify/codenotify.run/internal/conf"
+)
+
+func TestSafeRedirectTo(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/runs/01GA6V8X8JQ0D2XK1D3V3R6TSE", want: "/runs/01GA6V8X8JQ0D2XK1D3V3R6TSE"},
+		{path: "", want: "/"},
+		{path: "https://evil.com", want: "/"},
+		{path: "//evil.com", want: "/"},
+		{path: "/\\evil.com", want: "/"},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			assert.Equal(t, test.want, safeRedirectTo(test.path))
+		})
+	}
+}
+
+func TestHandleOAuthLogin(t *testing.T) {
+	config := &conf.Config{}
+	config.Server.ExternalURL = "https://codenotify.example.com"
+	apps := githubApps{
+		{GitHubApp: &conf.GitHubApp{Name: conf.DefaultGitHubApp, ClientID: "public-client-id", ClientSecret: "public-client-secret"}},
+		{GitHubApp: &conf.GitHubApp{Name: "internal", APIURL: "https://github.example.com/api/v3/", ClientID: "internal-client-id", ClientSecret: "internal-client-secret"}},
+		{GitHubApp: &conf.GitHubApp{Name: "no-oauth"}},
+	}
+	for _, app := range apps {
+		app.oauth = newOAuthConfig(config, app)
+	}
+	f := flamego.New()
+	f.Get("/-/oauth/login", session.Sessioner(), handleOAuthLogin(apps))
+
+	tests := []struct {
+		name         string
+		query        string
+		wantCode     int
+		wantLocation string
+	}{
+		{
+			name:         "default app",
+			query:        "redirect_to=%2Fruns%2F1",
+			wantCode:     http.StatusFound,
+			wantLocation: "https://github.com/login/oauth/authorize?client_id=public-client-id",
+		},
+		{
+			name:         "app on GitHub Enterprise Server",
+			query:        "app=internal&redirect_to=%2Fruns%2F1",
+			wantCode:     http.StatusFound,
+			wantLocation: "https://github.example.com/login/oauth/authorize?client_id=internal-client-id",
+		},
+		{
+			name:     "OAuth not configured",
+			query:    "app=no-oauth",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "unknown app",
+			query:    "app=unknown",
+			wantCode: http.StatusNotFound,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/-/oauth/login?"+test.query, nil)
+			require.NoError(t, err)
+
+			f.ServeHTTP(resp, req)
+			assert.Equal(t, test.wantCode, resp.Code)
+			assert.True(t, strings.HasPrefix(resp.Header().Get("Location"), test.wantLocation), resp.Header().Get("Location"))
+		})
+	}
+}
+
+func TestOAuthLogin_SharedSessions(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"user-token","token_type":"bearer"}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	config := &conf.Config{}
+	config.Server.ExternalURL = "https://codenotify.example.com"
+	config.Database.Type = conf.DatabaseSQLite
+	config.Database.Path = filepath.Join(t.TempDir(), "data", "codenotify.db")
+	apps := githubApps{
+		{GitHubApp: &conf.GitHubApp{Name: conf.DefaultGitHubApp, APIURL: server.URL + "/api/v3/", ClientID: "client-id", ClientSecret: "client-secret"}},
+	}
+	apps[0].oauth = newOAuthConfig(config, apps[0])
+
+	// Every request goes to a new replica, which only shares the session store
+	// with others.
+	newReplica := func() *flamego.Flame {
+		f := flamego.New()
+		sessioner, err := newSessioner(config)
+		require.NoError(t, err)
+		f.Group("/-/oauth", func() {
+			f.Get("/login", handleOAuthLogin(apps))
+			f.Get("/callback", handleOAuthCallback(apps))
+		}, sessioner)
+		f.Get("/token", sessioner, func(sess session.Session) string {
+			token, _ := sess.Get(oauthTokenKey(apps[0])).(string)
+			return token
+		})
+		return f
+	}
+	var cookies []*http.Cookie
+	serve := func(target string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodGet, target, nil)
+		require.NoError(t, err)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp := httptest.NewRecorder()
+		newReplica().ServeHTTP(resp, req)
+		cookies = append(cookies, resp.Result().Cookies()...)
+		return resp
+	}
+
+	resp := serve("/-/oauth/login?redirect_to=%2Fruns%2F1")
+	require.Equal(t, http.StatusFound, resp.Code)
+	authURL, err := url.Parse(resp.Header().Get("Location"))
+	require.NoError(t, err)
+	state := authURL.Query().Get("state")
+	require.NotEmpty(t, state)
+
+	resp = serve("/-/oauth/callback?code=code&state=" + url.QueryEscape(state))
+	require.Equal(t, http.StatusFound, resp.Code, resp.Body.String())
+	assert.Equal(t, "/runs/1", resp.Header().Get("Location"))
+
+	resp = serve("/token")
+	assert.Equal(t, "user-token", resp.Body.String())
+}
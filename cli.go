@@ -5,13 +5,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -23,15 +28,38 @@ func run(ctx context.Context, w io.Writer, command string, args ...string) ([]by
 	cmd := exec.CommandContext(ctx, command, args...)
 	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
 
-	out, err := cmd.CombinedOutput()
-	_, _ = fmt.Fprintln(w, string(out))
+	// NOTE: Both stdout and stderr are streamed to the run log as the command
+	// runs, but only stdout is returned because callers parse it as data, e.g.
+	// warnings of Git must not be taken as changed files.
+	var stdout bytes.Buffer
+	lw := &lockedWriter{w: w}
+	cmd.Stdout = io.MultiWriter(lw, &stdout)
+	cmd.Stderr = lw
+
+	err := cmd.Run()
+	_, _ = fmt.Fprintln(w)
 	if err != nil {
 		return nil, errors.Wrapf(err, "running command %q", cmdWithArgs)
 	}
-	return out, nil
+	return stdout.Bytes(), nil
+}
+
+// lockedWriter serializes writes to the underlying writer, because stdout and
+// stderr of a command are copied by separate goroutines.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
 }
 
-func checkout(ctx context.Context, w io.Writer, repoPath, remoteURL, headCommit string, commitsCount int) error {
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// clone fetches the head commit of the remote into a new repository with a
+// depth of one.
+func clone(ctx context.Context, w io.Writer, repoPath, remoteURL, headCommit string) error {
 	out, err := run(ctx, w, "git", "init", repoPath)
 	if err != nil {
 		return fmt.Errorf("init: %v - %s", err, out)
@@ -55,8 +83,13 @@ func checkout(ctx context.Context, w io.Writer, repoPath, remoteURL, headCommit
 	if err != nil {
 		return fmt.Errorf("fetch origin: %v - %s", err, out)
 	}
+	return nil
+}
 
-	_, err = run(
+// deepen deepens the history of the cloned repository by the number of commits,
+// which makes the base commit of the pull request available.
+func deepen(ctx context.Context, w io.Writer, repoPath string, commitsCount int) error {
+	out, err := run(
 		ctx,
 		w,
 		"git",
@@ -71,22 +104,86 @@ func checkout(ctx context.Context, w io.Writer, repoPath, remoteURL, headCommit
 	return nil
 }
 
-func codenotify(ctx context.Context, w io.Writer, binPath, repoPath, baseRef, headRef, author string) (string, error) {
-	output, err := run(
+// diffNames returns names of files changed between the base and the head refs.
+func diffNames(ctx context.Context, w io.Writer, repoPath, baseRef, headRef string) ([]string, error) {
+	out, err := run(
 		ctx,
 		w,
-		binPath,
-		"--cwd", repoPath,
-		"--baseRef", baseRef,
-		"--headRef", headRef,
-		"--author", "@"+author,
-		"--format=markdown",
-		"--filename=CODENOTIFY",
-		"--subscriber-threshold=10",
-		"--verbose",
+		"git",
+		"-C", repoPath,
+		"-c", "core.quotePath=false",
+		"diff", "--name-only", "--no-renames",
+		baseRef+"..."+headRef,
 	)
 	if err != nil {
-		return "", fmt.Errorf("run: %v - %s", err, output)
+		return nil, fmt.Errorf("diff: %v - %s", err, out)
 	}
-	return string(output), nil
+
+	var names []string
+	for _, name := range strings.Split(string(out), "\n") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// gitFS is a read-only file system of the Git tree at a revision, which is only
+// capable of opening regular files.
+type gitFS struct {
+	ctx      context.Context
+	repoPath string
+	rev      string
 }
+
+// newGitFS returns the file system of the Git tree at the revision, which must
+// be a valid commit.
+func newGitFS(ctx context.Context, w io.Writer, repoPath, rev string) (*gitFS, error) {
+	out, err := run(ctx, w, "git", "-C", repoPath, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil {
+		return nil, fmt.Errorf("verify revision: %v - %s", err, out)
+	}
+	return &gitFS{
+		ctx:      ctx,
+		repoPath: repoPath,
+		rev:      rev,
+	}, nil
+}
+
+func (fsys *gitFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	// NOTE: The revision has been verified, thus any failure of reading the blob
+	// means the file does not exist (or is not a regular file).
+	data, err := exec.CommandContext(fsys.ctx, "git", "-C", fsys.repoPath, "cat-file", "blob", fsys.rev+":"+name).Output()
+	if err != nil {
+		if fsys.ctx.Err() != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fsys.ctx.Err()}
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &gitFile{
+		Reader: bytes.NewReader(data),
+		name:   path.Base(name),
+		size:   int64(len(data)),
+	}, nil
+}
+
+// gitFile is a regular file opened from the gitFS.
+type gitFile struct {
+	*bytes.Reader
+	name string
+	size int64
+}
+
+func (f *gitFile) Stat() (fs.FileInfo, error) { return f, nil }
+func (*gitFile) Close() error                 { return nil }
+func (f *gitFile) Name() string               { return f.name }
+func (f *gitFile) Size() int64                { return f.size }
+func (*gitFile) Mode() fs.FileMode            { return 0444 }
+func (*gitFile) ModTime() time.Time           { return time.Time{} }
+func (*gitFile) IsDir() bool                  { return false }
+func (*gitFile) Sys() any                     { return nil }
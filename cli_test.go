@@ -0,0 +1,23 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	var w bytes.Buffer
+	out, err := run(context.Background(), &w, "sh", "-c", "echo main.go; echo 'warning: refname is ambiguous' >&2")
+	require.NoError(t, err)
+	assert.Equal(t, "main.go\n", string(out), "only stdout is returned")
+	assert.Contains(t, w.String(), "main.go\n", "stdout is streamed to the log")
+	assert.Contains(t, w.String(), "warning: refname is ambiguous\n", "stderr is streamed to the log")
+}
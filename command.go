@@ -0,0 +1,281 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v45/github"
+	"github.com/pkg/errors"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/codenotify/codenotify.run/internal/codenotify"
+	"github.com/codenotify/codenotify.run/internal/conf"
+	"github.com/codenotify/codenotify.run/internal/queue"
+	"github.com/codenotify/codenotify.run/internal/repoconf"
+	"github.com/codenotify/codenotify.run/internal/rundb"
+	"github.com/codenotify/codenotify.run/internal/runlog"
+)
+
+// slashCommandPrefix is the prefix of slash commands in pull request comments.
+const slashCommandPrefix = "/codenotify"
+
+// slashCommand is a command issued in a pull request comment, e.g.
+// "/codenotify explain path/to/file".
+type slashCommand struct {
+	Name string
+	Args []string
+}
+
+// parseSlashCommand parses the first slash command in the comment body. It
+// returns false if the body does not contain any slash command.
+func parseSlashCommand(body string) (*slashCommand, bool) {
+	for _, line := range strings.Split(body, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != slashCommandPrefix {
+			continue
+		}
+
+		cmd := &slashCommand{Args: []string{}}
+		if len(fields) > 1 {
+			cmd.Name = strings.ToLower(fields[1])
+			cmd.Args = fields[2:]
+		}
+		return cmd, true
+	}
+	return nil, false
+}
+
+const slashCommandUsage = "Available commands are:\n\n" +
+	"- `/codenotify rerun`: Run Codenotify again on this pull request.\n" +
+	"- `/codenotify explain <path>`: Show who is notified for the file.\n" +
+	"- `/codenotify mute`: Stop updating the report on this pull request.\n" +
+	"- `/codenotify unmute`: Resume updating the report on this pull request.\n"
+
+// processIssueComment processes the slash command in the pull request comment.
+func processIssueComment(ctx context.Context, config *conf.Config, app *githubApp, runs *runRegistry, store runlog.Store, db *rundb.DB, job *queue.Job, payload *github.IssueCommentEvent) error {
+	cmd, ok := parseSlashCommand(payload.GetComment().GetBody())
+	if !ok {
+		return nil
+	}
+
+	client, token, err := newGitHubClient(ctx, app, *payload.Installation.ID)
+	if err != nil {
+		return errors.Wrap(err, "create GitHub client")
+	}
+
+	owner := payload.GetRepo().GetOwner().GetLogin()
+	repo := payload.GetRepo().GetName()
+	commenter := payload.GetComment().GetUser().GetLogin()
+	react := func(content string) {
+		_, _, err := client.Reactions.CreateIssueCommentReaction(ctx, owner, repo, payload.GetComment().GetID(), content)
+		if err != nil {
+			log.Error("Failed to react to comment %s: %v", payload.GetComment().GetHTMLURL(), err)
+		}
+	}
+	reply := func(body string) error {
+		_, _, err := client.Issues.CreateComment(
+			ctx,
+			owner,
+			repo,
+			payload.GetIssue().GetNumber(),
+			&github.IssueComment{
+				Body: github.String(body),
+			},
+		)
+		return err
+	}
+
+	permission, _, err := client.Repositories.GetPermissionLevel(ctx, owner, repo, commenter)
+	if err != nil {
+		return errors.Wrapf(err, "get permission level of %q", commenter)
+	}
+	switch permission.GetPermission() {
+	case "admin", "write":
+	default:
+		react("-1")
+		return reply(fmt.Sprintf("@%s Only users with write access to the repository can run Codenotify commands.", commenter))
+	}
+
+	pr, _, err := client.PullRequests.Get(ctx, owner, repo, payload.GetIssue().GetNumber())
+	if err != nil {
+		return errors.Wrapf(err, "get pull request #%d", payload.GetIssue().GetNumber())
+	}
+	prPayload := &github.PullRequestEvent{
+		Action:       github.String("synchronize"),
+		Number:       pr.Number,
+		PullRequest:  pr,
+		Repo:         payload.Repo,
+		Installation: payload.Installation,
+	}
+
+	switch cmd.Name {
+	case "rerun":
+		react("+1")
+		return processPullRequest(ctx, config, app, runs, store, db, job, prPayload)
+
+	case "explain":
+		if len(cmd.Args) != 1 {
+			react("confused")
+			return reply(fmt.Sprintf("@%s Please specify exactly one file path, e.g. `/codenotify explain path/to/file`.", commenter))
+		}
+		react("eyes")
+
+		repoConfig, err := loadRepoConfig(ctx, app, client, prPayload)
+		var invalidConfig *repoconf.ValidationError
+		if errors.As(err, &invalidConfig) {
+			return reply(fmt.Sprintf("@%s Unable to run Codenotify because of invalid configuration file `%s`: %s", commenter, repoconf.Path, strings.Join(invalidConfig.Problems, "; ")))
+		} else if err != nil {
+			return errors.Wrap(err, "load configuration file")
+		}
+
+		runID := runlog.NewID()
+		logCtx := context.WithoutCancel(ctx)
+		w := newRunLogWriter(logCtx, app, store, runID, jobTrigger(job), prPayload, token)
+		report, err := checkoutAndRun(ctx, config, w, repoConfig, prPayload, token)
+		state := runStateSuccess
+		if err != nil {
+			state = runStateError
+		}
+		w.SetOutcome(string(state), report)
+		if err := w.Close(logCtx); err != nil {
+			log.Error("Failed to save run log: %v", err)
+		}
+		logURL := runLogURL(config, runID)
+		if err != nil {
+			if err := reply(fmt.Sprintf("@%s Failed to run Codenotify, see the [run log](%s) for details.", commenter, logURL)); err != nil {
+				log.Error("Failed to reply to comment %s: %v", payload.GetComment().GetHTMLURL(), err)
+			}
+			return errors.Wrap(err, "checkout and run")
+		}
+		return reply(explainFile(report, cmd.Args[0], logURL))
+
+	case "mute":
+		react("+1")
+
+		// NOTE: The report marker contains the name of files that contain rules,
+		// which may be customized by the repository.
+		repoConfig, err := loadRepoConfig(ctx, app, client, prPayload)
+		var invalidConfig *repoconf.ValidationError
+		if errors.As(err, &invalidConfig) {
+			return reply(fmt.Sprintf("@%s Unable to mute Codenotify because of invalid configuration file `%s`: %s", commenter, repoconf.Path, strings.Join(invalidConfig.Problems, "; ")))
+		} else if err != nil {
+			return errors.Wrap(err, "load configuration file")
+		}
+		return muteReport(ctx, client, prPayload, commenter, codenotify.ReportMarker(repoConfig.Filename))
+
+	case "unmute":
+		react("+1")
+		err = unmuteReport(ctx, client, prPayload)
+		if err != nil {
+			return errors.Wrap(err, "unmute report")
+		}
+		// Catch up with the changes that were made while muted.
+		return processPullRequest(ctx, config, app, runs, store, db, job, prPayload)
+
+	default:
+		react("confused")
+		return reply(fmt.Sprintf("@%s Unknown command %q. %s", commenter, cmd.Name, slashCommandUsage))
+	}
+}
+
+// explainFile returns the Markdown reply that explains who are notified for
+// the file in the report and by which rules.
+func explainFile(report *codenotify.Report, file, logURL string) string {
+	if report.ThresholdExceeded {
+		return fmt.Sprintf("Nobody is notified in this pull request because the number of subscribers has exceeded the threshold, see the [run log](%s) for details.", logURL)
+	}
+
+	file = strings.TrimPrefix(file, "/")
+	subscribers := report.Subscribers[file]
+	if len(subscribers) == 0 {
+		return fmt.Sprintf("No subscribers are notified for `%s` in this pull request, see the [run log](%s) for details.", file, logURL)
+	}
+
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "Subscribers notified for `%s` in this pull request: %s.\n\n", file, strings.Join(subscribers, ", "))
+	for _, rule := range report.MatchedRules {
+		for _, f := range rule.Files {
+			if f == file {
+				_, _ = fmt.Fprintf(&b, "- `%s`: `%s` %s\n", rule.Location(), rule.Pattern, strings.Join(rule.Subscribers, " "))
+				break
+			}
+		}
+	}
+	if report.RulesUnavailable {
+		_, _ = fmt.Fprint(&b, "Matched rules are not available because Codenotify runs via its binary on this server.\n")
+	}
+	_, _ = fmt.Fprintf(&b, "\nSee the [run log](%s) for details.", logURL)
+	return b.String()
+}
+
+// muteReport marks the report comment of the pull request as muted, or creates
+// a muted one with the report marker if there is no report yet.
+func muteReport(ctx context.Context, client *github.Client, payload *github.PullRequestEvent, commenter, reportMarker string) error {
+	comment, err := findReportComment(ctx, client, payload)
+	if err != nil {
+		return errors.Wrap(err, "find report comment")
+	}
+
+	notice := fmt.Sprintf("%s\n> Codenotify has been muted for this pull request by @%s, comment `/codenotify unmute` to resume.\n\n", mutedMarker, commenter)
+	if comment == nil {
+		_, _, err = client.Issues.CreateComment(
+			ctx,
+			*payload.Repo.Owner.Login,
+			*payload.Repo.Name,
+			*payload.PullRequest.Number,
+			&github.IssueComment{
+				Body: github.String(notice + reportMarker),
+			},
+		)
+		return errors.Wrap(err, "create comment")
+	} else if strings.Contains(comment.GetBody(), mutedMarker) {
+		return nil
+	}
+
+	_, _, err = client.Issues.EditComment(
+		ctx,
+		*payload.Repo.Owner.Login,
+		*payload.Repo.Name,
+		comment.GetID(),
+		&github.IssueComment{
+			Body: github.String(notice + comment.GetBody()),
+		},
+	)
+	return errors.Wrap(err, "edit comment")
+}
+
+// unmuteReport removes the muted notice from the report comment of the pull
+// request.
+func unmuteReport(ctx context.Context, client *github.Client, payload *github.PullRequestEvent) error {
+	comment, err := findReportComment(ctx, client, payload)
+	if err != nil {
+		return errors.Wrap(err, "find report comment")
+	} else if comment == nil || !strings.Contains(comment.GetBody(), mutedMarker) {
+		return nil
+	}
+
+	body := comment.GetBody()
+	start := strings.Index(body, mutedMarker)
+	end := strings.Index(body[start:], "\n\n")
+	if end < 0 {
+		body = body[:start]
+	} else {
+		body = body[:start] + body[start+end+2:]
+	}
+
+	_, _, err = client.Issues.EditComment(
+		ctx,
+		*payload.Repo.Owner.Login,
+		*payload.Repo.Name,
+		comment.GetID(),
+		&github.IssueComment{
+			Body: github.String(body),
+		},
+	)
+	return errors.Wrap(err, "edit comment")
+}
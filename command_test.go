@@ -0,0 +1,180 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codenotify/codenotify.run/internal/codenotify"
+	"github.com/codenotify/codenotify.run/internal/conf"
+	"github.com/codenotify/codenotify.run/internal/queue"
+	"github.com/codenotify/codenotify.run/internal/repoconf"
+)
+
+func TestParseSlashCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		want   *slashCommand
+		wantOK bool
+	}{
+		{
+			name:   "no command",
+			body:   "LGTM, but /codenotify rerun is not at the start",
+			wantOK: false,
+		},
+		{
+			name:   "different prefix",
+			body:   "/codenotifyrerun",
+			wantOK: false,
+		},
+		{
+			name:   "rerun",
+			body:   "/codenotify rerun",
+			want:   &slashCommand{Name: "rerun", Args: []string{}},
+			wantOK: true,
+		},
+		{
+			name:   "explain with surrounding text",
+			body:   "Hmm, who gets notified?\r\n\r\n  /codenotify Explain internal/conf/conf.go\r\n",
+			want:   &slashCommand{Name: "explain", Args: []string{"internal/conf/conf.go"}},
+			wantOK: true,
+		},
+		{
+			name:   "no name",
+			body:   "/codenotify",
+			want:   &slashCommand{Args: []string{}},
+			wantOK: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := parseSlashCommand(test.body)
+			assert.Equal(t, test.wantOK, ok)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestExplainFile(t *testing.T) {
+	report := &codenotify.Report{
+		MatchedRules: []*codenotify.Rule{
+			{
+				Source:      "CODENOTIFY",
+				Line:        1,
+				Pattern:     "**/*.go",
+				Subscribers: []string{"@alice"},
+				Files:       []string{"internal/conf/conf.go", "main.go"},
+			},
+			{
+				Source:      "internal/CODENOTIFY",
+				Line:        2,
+				Pattern:     "conf/**",
+				Subscribers: []string{"@codenotify/maintainers"},
+				Files:       []string{"internal/conf/conf.go"},
+			},
+		},
+		Subscribers: map[string][]string{
+			"main.go":               {"@alice"},
+			"internal/conf/conf.go": {"@alice", "@codenotify/maintainers"},
+		},
+	}
+	got := explainFile(report, "/internal/conf/conf.go", "https://codenotify.run/runs/01GA")
+	want := "Subscribers notified for `internal/conf/conf.go` in this pull request: @alice, @codenotify/maintainers.\n\n" +
+		"- `CODENOTIFY:1`: `**/*.go` @alice\n" +
+		"- `internal/CODENOTIFY:2`: `conf/**` @codenotify/maintainers\n" +
+		"\nSee the [run log](https://codenotify.run/runs/01GA) for details."
+	assert.Equal(t, want, got)
+
+	got = explainFile(report, "README.md", "https://codenotify.run/runs/01GA")
+	assert.Equal(t, "No subscribers are notified for `README.md` in this pull request, see the [run log](https://codenotify.run/runs/01GA) for details.", got)
+
+	// Reports of the binary engine do not tell matched rules.
+	report = &codenotify.Report{
+		Subscribers:      map[string][]string{"main.go": {"@alice"}},
+		RulesUnavailable: true,
+	}
+	got = explainFile(report, "main.go", "https://codenotify.run/runs/01GA")
+	want = "Subscribers notified for `main.go` in this pull request: @alice.\n\n" +
+		"Matched rules are not available because Codenotify runs via its binary on this server.\n" +
+		"\nSee the [run log](https://codenotify.run/runs/01GA) for details."
+	assert.Equal(t, want, got)
+}
+
+func TestProcessIssueComment_Mute(t *testing.T) {
+	var created []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v3/repos/codenotify/codenotify.run/issues/comments/1/reactions", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{}`))
+	})
+	mux.HandleFunc("GET /api/v3/repos/codenotify/codenotify.run/collaborators/alice/permission", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"permission":"write"}`))
+	})
+	mux.HandleFunc("GET /api/v3/repos/codenotify/codenotify.run/pulls/1", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"number":1,"base":{"sha":"base"},"head":{"sha":"head"}}`))
+	})
+	mux.HandleFunc("GET /api/v3/repos/codenotify/codenotify.run/contents/.github/codenotify.yml", func(w http.ResponseWriter, r *http.Request) {
+		content := base64.StdEncoding.EncodeToString([]byte("filename: OWNERS\n"))
+		_, _ = w.Write([]byte(`{"type":"file","encoding":"base64","content":"` + content + `"}`))
+	})
+	mux.HandleFunc("GET /api/v3/repos/codenotify/codenotify.run/issues/1/comments", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[]`))
+	})
+	mux.HandleFunc("POST /api/v3/repos/codenotify/codenotify.run/issues/1/comments", func(w http.ResponseWriter, r *http.Request) {
+		var comment github.IssueComment
+		_ = json.NewDecoder(r.Body).Decode(&comment)
+		created = append(created, comment.GetBody())
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	app := &githubApp{
+		GitHubApp: &conf.GitHubApp{
+			Name:      conf.DefaultGitHubApp,
+			APIURL:    server.URL + "/api/v3/",
+			UploadURL: server.URL + "/api/uploads/",
+			RepoDefaults: repoconf.Config{
+				Filename:     "CODENOTIFY",
+				CommentStyle: repoconf.CommentStyleTable,
+				RulesFrom:    repoconf.RulesFromHead,
+			},
+		},
+		tokens: newTokenCache(func(context.Context, int64) (string, time.Time, error) {
+			return "token", time.Now().Add(time.Hour), nil
+		}),
+	}
+	payload := &github.IssueCommentEvent{
+		Action:       github.String("created"),
+		Installation: &github.Installation{ID: github.Int64(1)},
+		Repo: &github.Repository{
+			Owner: &github.User{Login: github.String("codenotify")},
+			Name:  github.String("codenotify.run"),
+		},
+		Issue: &github.Issue{Number: github.Int(1)},
+		Comment: &github.IssueComment{
+			ID:   github.Int64(1),
+			Body: github.String("/codenotify mute"),
+			User: &github.User{Login: github.String("alice")},
+		},
+	}
+	err := processIssueComment(context.Background(), &conf.Config{}, app, newRunRegistry(), nil, nil, &queue.Job{}, payload)
+	require.NoError(t, err)
+	require.Len(t, created, 1)
+	assert.Contains(t, created[0], mutedMarker)
+	assert.Contains(t, created[0], codenotify.ReportMarker("OWNERS"), "uses the filename of the repository")
+}
@@ -0,0 +1,139 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/flamego/flamego"
+	"github.com/flamego/session"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/codenotify/codenotify.run/internal/queue"
+	"github.com/codenotify/codenotify.run/internal/rundb"
+)
+
+const (
+	// dashboardRecentRuns is the number of recent runs shown on the dashboard.
+	dashboardRecentRuns = 50
+	// dashboardSlowestRepositories is the number of slowest repositories shown on
+	// the dashboard.
+	dashboardSlowestRepositories = 10
+)
+
+// isAdmin returns true if the user has logged in as an admin.
+func isAdmin(sess session.Session) bool {
+	admin, _ := sess.Get(sessionKeyAdmin).(bool)
+	return admin
+}
+
+// handleAdminLogin returns the handler that logs in the user as an admin with
+// the admin token.
+func handleAdminLogin(token string) flamego.Handler {
+	return func(c flamego.Context, sess session.Session) (int, []byte) {
+		redirectTo := safeRedirectTo(c.Request().FormValue("redirect_to"))
+		if c.Request().Method != http.MethodPost {
+			return renderTemplate(c, http.StatusOK, "login.html", map[string]any{"RedirectTo": redirectTo})
+		}
+
+		if subtle.ConstantTimeCompare([]byte(c.Request().PostFormValue("token")), []byte(token)) != 1 {
+			return renderTemplate(c, http.StatusUnauthorized, "login.html",
+				map[string]any{
+					"RedirectTo": redirectTo,
+					"Error":      "Invalid admin token",
+				},
+			)
+		}
+
+		sess.Set(sessionKeyAdmin, true)
+		c.Redirect(redirectTo)
+		return http.StatusFound, nil
+	}
+}
+
+// handleAdminLogout logs out the admin.
+func handleAdminLogout(c flamego.Context, sess session.Session) {
+	sess.Delete(sessionKeyAdmin)
+	c.Redirect("/")
+}
+
+// runStats is the statistics of runs within a time window.
+type runStats struct {
+	Window string
+	Total  int
+	States map[string]int
+}
+
+// FailureRate returns the percentage of runs that failed with errors.
+func (s *runStats) FailureRate() float64 {
+	if s.Total == 0 {
+		return 0
+	}
+	return float64(s.States[string(runStateError)]) / float64(s.Total) * 100
+}
+
+// handleDashboard returns the handler that renders the overview of the service
+// for admins. Other users are redirected to the project page instead.
+func handleDashboard(db *rundb.DB, q *queue.Queue) flamego.Handler {
+	return func(c flamego.Context, sess session.Session) (int, []byte) {
+		if !isAdmin(sess) {
+			c.Redirect("https://github.com/codenotify/codenotify.run")
+			return http.StatusFound, nil
+		}
+
+		ctx := c.Request().Context()
+		now := time.Now()
+		var stats []*runStats
+		windows := []struct {
+			name     string
+			duration time.Duration
+		}{
+			{"24 hours", 24 * time.Hour},
+			{"7 days", 7 * 24 * time.Hour},
+		}
+		for _, window := range windows {
+			states, err := db.CountStates(ctx, now.Add(-window.duration))
+			if err != nil {
+				log.Error("Failed to count states of runs: %v", err)
+				return http.StatusInternalServerError, []byte("Failed to get run statistics")
+			}
+			s := &runStats{Window: window.name, States: states}
+			for _, count := range states {
+				s.Total += count
+			}
+			stats = append(stats, s)
+		}
+
+		slowest, err := db.SlowestRepositories(ctx, now.Add(-7*24*time.Hour), dashboardSlowestRepositories)
+		if err != nil {
+			log.Error("Failed to get slowest repositories: %v", err)
+			return http.StatusInternalServerError, []byte("Failed to get run statistics")
+		}
+
+		runs, err := db.ListRuns(ctx, rundb.ListRunsOptions{Limit: dashboardRecentRuns})
+		if err != nil {
+			log.Error("Failed to list runs: %v", err)
+			return http.StatusInternalServerError, []byte("Failed to list runs")
+		}
+
+		pending, running, err := q.Depth()
+		if err != nil {
+			log.Error("Failed to get queue depth: %v", err)
+			return http.StatusInternalServerError, []byte("Failed to get queue depth")
+		}
+
+		return renderTemplate(c, http.StatusOK, "dashboard.html",
+			map[string]any{
+				"Stats":   stats,
+				"Slowest": slowest,
+				"Runs":    runs,
+				"Pending": pending,
+				"Running": running,
+			},
+		)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flamego/flamego"
+	"github.com/flamego/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codenotify/codenotify.run/internal/queue"
+	"github.com/codenotify/codenotify.run/internal/rundb"
+	"github.com/codenotify/codenotify.run/internal/runlog"
+)
+
+func TestDashboard(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db, err := rundb.Open(ctx, rundb.TypeSQLite, filepath.Join(dir, "codenotify.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	q, err := queue.Open(filepath.Join(dir, "queue.db"), time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = q.Close() })
+
+	run := &rundb.Run{
+		ID:          runlog.NewID().String(),
+		Repository:  "codenotify/codenotify.run",
+		PullRequest: 1234,
+		State:       string(runStateError),
+		StartedAt:   time.Now().Add(-time.Hour),
+		Duration:    2 * time.Second,
+		Error:       "clone pull request: exit status 128",
+	}
+	require.NoError(t, db.CreateRun(ctx, run))
+	_, err = q.Enqueue("default", "", "pull_request", 1, []byte(`{}`))
+	require.NoError(t, err)
+
+	f := flamego.New()
+	sessioner := session.Sessioner()
+	f.Get("/", sessioner, handleDashboard(db, q))
+	f.Group("/-/admin", func() {
+		f.Combo("/login").Get(handleAdminLogin("admin-token")).Post(handleAdminLogin("admin-token"))
+		f.Post("/logout", handleAdminLogout)
+	}, sessioner)
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(t *testing.T, path string) (*http.Response, string) {
+		resp, err := client.Get(server.URL + path)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+	login := func(t *testing.T, token string) *http.Response {
+		resp, err := client.PostForm(server.URL+"/-/admin/login", url.Values{"token": {token}, "redirect_to": {"/"}})
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	// Visitors are sent to the project page.
+	resp, _ := get(t, "/")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "https://github.com/codenotify/codenotify.run", resp.Header.Get("Location"))
+
+	resp, body := get(t, "/-/admin/login?redirect_to=/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `name="redirect_to" value="/"`)
+
+	resp = login(t, "wrong-token")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, _ = get(t, "/")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	resp = login(t, "admin-token")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/", resp.Header.Get("Location"))
+
+	resp, body = get(t, "/")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "<tr><th>Pending</th><td>1</td></tr>")
+	assert.Contains(t, body, `<a href="/runs/`+run.ID+`">`)
+	assert.Contains(t, body, "100.0%")
+	assert.Contains(t, body, "<tr><td>codenotify/codenotify.run</td><td>1</td><td>2s</td><td>2s</td></tr>")
+
+	resp, err = client.Post(server.URL+"/-/admin/logout", "", nil)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	resp, _ = get(t, "/")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+}
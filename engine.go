@@ -0,0 +1,184 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/codenotify/codenotify.run/internal/codenotify"
+	"github.com/codenotify/codenotify.run/internal/conf"
+	"github.com/codenotify/codenotify.run/internal/repoconf"
+)
+
+// engineOptions contains the options to run Codenotify.
+type engineOptions struct {
+	RepoPath            string
+	BaseRef             string
+	HeadRef             string
+	Author              string // The GitHub username without the "@" prefix
+	Filename            string
+	SubscriberThreshold int
+	IgnoredPaths        []string
+	RulesFrom           string
+}
+
+// engine runs Codenotify against a fetched repository.
+type engine interface {
+	// Run runs Codenotify for changes between the base and the head refs, and
+	// writes progress to the given writer.
+	Run(ctx context.Context, w io.Writer, opts engineOptions) (*codenotify.Report, error)
+}
+
+// newEngine returns the engine according to the configuration.
+func newEngine(config *conf.Config) engine {
+	if config.Codenotify.Engine == conf.EngineBinary {
+		return &binaryEngine{binPath: config.Codenotify.BinPath}
+	}
+	return &builtinEngine{}
+}
+
+// builtinEngine runs Codenotify in-process.
+type builtinEngine struct{}
+
+func (*builtinEngine) Run(ctx context.Context, w io.Writer, opts engineOptions) (*codenotify.Report, error) {
+	files, err := diffNames(ctx, w, opts.RepoPath, opts.BaseRef, opts.HeadRef)
+	if err != nil {
+		return nil, errors.Wrap(err, "diff")
+	}
+
+	var revisions []codenotify.Revision
+	addRevision := func(name, rev string) error {
+		fsys, err := newGitFS(ctx, w, opts.RepoPath, rev)
+		if err != nil {
+			return errors.Wrapf(err, "new Git file system of %s", name)
+		}
+		revisions = append(revisions, codenotify.Revision{Name: name, FS: fsys})
+		return nil
+	}
+	switch opts.RulesFrom {
+	case repoconf.RulesFromBase:
+		err = addRevision("base", opts.BaseRef)
+	case repoconf.RulesFromUnion:
+		err = addRevision("base", opts.BaseRef)
+		if err == nil {
+			err = addRevision("head", opts.HeadRef)
+		}
+	default:
+		err = addRevision("head", opts.HeadRef)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := codenotify.MatchRevisions(
+		revisions,
+		files,
+		codenotify.Options{
+			Filename:            opts.Filename,
+			Author:              "@" + opts.Author,
+			SubscriberThreshold: opts.SubscriberThreshold,
+			IgnoredPaths:        opts.IgnoredPaths,
+		},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "match")
+	} else if ctx.Err() != nil {
+		// Missing rule files are indistinguishable from failed reads once the
+		// context is cancelled, thus the result is not reliable.
+		return nil, ctx.Err()
+	}
+
+	report.BaseRef = opts.BaseRef
+	report.HeadRef = opts.HeadRef
+	return report, nil
+}
+
+// binaryEngine runs Codenotify via its binary.
+type binaryEngine struct {
+	binPath string
+}
+
+func (e *binaryEngine) Run(ctx context.Context, w io.Writer, opts engineOptions) (*codenotify.Report, error) {
+	if opts.RulesFrom != "" && opts.RulesFrom != repoconf.RulesFromHead {
+		return nil, errors.Errorf("reading rules from %q is not supported by the binary engine", opts.RulesFrom)
+	}
+
+	// NOTE: The text output of the binary only tells changed files that have
+	// subscribers, thus all changed files are listed separately.
+	files, err := diffNames(ctx, w, opts.RepoPath, opts.BaseRef, opts.HeadRef)
+	if err != nil {
+		return nil, errors.Wrap(err, "diff")
+	}
+
+	output, err := run(
+		ctx,
+		w,
+		e.binPath,
+		"--cwd", opts.RepoPath,
+		"--baseRef", opts.BaseRef,
+		"--headRef", opts.HeadRef,
+		"--author", "@"+opts.Author,
+		"--format=text",
+		"--filename="+opts.Filename,
+		// NOTE: The binary does not support ignored paths, thus the threshold is
+		// checked after changed files are filtered.
+		"--subscriber-threshold=0",
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "run")
+	}
+
+	report := parseTextOutput(string(output))
+	_, _ = io.WriteString(w, "NOTE: Matched rules are not available with the binary engine, use the builtin engine for details of rules.\n")
+	report.Filename = opts.Filename
+	report.BaseRef = opts.BaseRef
+	report.HeadRef = opts.HeadRef
+	report.SubscriberThreshold = opts.SubscriberThreshold
+	report.ChangedFiles = files
+	sort.Strings(report.ChangedFiles)
+	report.ModifiedRuleFiles = codenotify.RuleFiles(files, opts.Filename)
+	err = report.Ignore(opts.IgnoredPaths)
+	if err != nil {
+		return nil, errors.Wrap(err, "ignore paths")
+	}
+	return report, nil
+}
+
+// parseTextOutput parses the text output of the Codenotify binary, which lists
+// subscribers with their files in lines like "@alice -> a.go, b.go". The text
+// output does not tell changed files without subscribers nor matched rules,
+// thus the report is less detailed than the one of the builtin engine.
+//
+// NOTE: The Codenotify binary only supports the text and the Markdown formats,
+// neither of which contains the source and the line of rules.
+func parseTextOutput(output string) *codenotify.Report {
+	report := &codenotify.Report{
+		Subscribers:      make(map[string][]string),
+		RulesUnavailable: true,
+	}
+	for _, line := range strings.Split(output, "\n") {
+		subscriber, files, ok := strings.Cut(line, " -> ")
+		if !ok {
+			continue
+		}
+		subscriber = strings.TrimSpace(subscriber)
+		for _, file := range strings.Split(files, ",") {
+			file = strings.TrimSpace(file)
+			if file != "" {
+				report.Subscribers[file] = append(report.Subscribers[file], subscriber)
+			}
+		}
+	}
+	for file := range report.Subscribers {
+		report.ChangedFiles = append(report.ChangedFiles, file)
+	}
+	sort.Strings(report.ChangedFiles)
+	return report
+}
@@ -0,0 +1,171 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codenotify/codenotify.run/internal/codenotify"
+	"github.com/codenotify/codenotify.run/internal/repoconf"
+)
+
+// newTestRepo creates a Git repository for tests, and returns its path along
+// with helpers to run Git commands and write files in the repository.
+func newTestRepo(t *testing.T) (repoPath string, git func(args ...string) string, writeFile func(name, content string)) {
+	repoPath = t.TempDir()
+	git = func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", repoPath}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=codenotify",
+			"GIT_AUTHOR_EMAIL=codenotify@example.com",
+			"GIT_COMMITTER_NAME=codenotify",
+			"GIT_COMMITTER_EMAIL=codenotify@example.com",
+		)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	writeFile = func(name, content string) {
+		name = filepath.Join(repoPath, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), os.ModePerm))
+		require.NoError(t, os.WriteFile(name, []byte(content), 0600))
+	}
+	git("init")
+	return repoPath, git, writeFile
+}
+
+func TestBuiltinEngine(t *testing.T) {
+	repoPath, git, writeFile := newTestRepo(t)
+
+	writeFile("CODENOTIFY", "**/*.md @docs\n")
+	writeFile("internal/CODENOTIFY", "conf/** @alice @bob\n")
+	git("add", "-A")
+	git("commit", "-m", "base")
+	baseRef := git("rev-parse", "HEAD")
+
+	writeFile("README.md", "# codenotify.run\n")
+	writeFile("internal/conf/conf.go", "package conf\n")
+	writeFile("main.go", "package main\n")
+	// The head unsubscribes "@alice" from changes of the same pull request.
+	writeFile("internal/CODENOTIFY", "conf/** @bob @carol\n")
+	git("add", "-A")
+	git("commit", "-m", "head")
+	headRef := git("rev-parse", "HEAD")
+
+	tests := []struct {
+		rulesFrom string
+		want      map[string][]string
+	}{
+		{
+			rulesFrom: repoconf.RulesFromHead,
+			want: map[string][]string{
+				"README.md":             {"@docs"},
+				"internal/conf/conf.go": {"@carol"},
+			},
+		},
+		{
+			rulesFrom: repoconf.RulesFromBase,
+			want: map[string][]string{
+				"README.md":             {"@docs"},
+				"internal/conf/conf.go": {"@alice"},
+			},
+		},
+		{
+			rulesFrom: repoconf.RulesFromUnion,
+			want: map[string][]string{
+				"README.md":             {"@docs"},
+				"internal/conf/conf.go": {"@alice", "@carol"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.rulesFrom, func(t *testing.T) {
+			got, err := (&builtinEngine{}).Run(
+				context.Background(),
+				&bytes.Buffer{},
+				engineOptions{
+					RepoPath:  repoPath,
+					BaseRef:   baseRef,
+					HeadRef:   headRef,
+					Author:    "bob",
+					Filename:  "CODENOTIFY",
+					RulesFrom: test.rulesFrom,
+				},
+			)
+			require.NoError(t, err)
+
+			assert.Equal(t, baseRef, got.BaseRef)
+			assert.Equal(t, headRef, got.HeadRef)
+			assert.Equal(t, []string{"README.md", "internal/CODENOTIFY", "internal/conf/conf.go", "main.go"}, got.ChangedFiles)
+			assert.Equal(t, []string{"internal/CODENOTIFY"}, got.ModifiedRuleFiles)
+			assert.Equal(t, test.want, got.Subscribers)
+		})
+	}
+}
+
+func TestBinaryEngine(t *testing.T) {
+	repoPath, git, writeFile := newTestRepo(t)
+	writeFile("CODENOTIFY", "**/*.go @alice\n")
+	git("add", "-A")
+	git("commit", "-m", "base")
+	baseRef := git("rev-parse", "HEAD")
+	writeFile("main.go", "package main\n")
+	writeFile("README.md", "# Codenotify\n")
+	git("add", "-A")
+	git("commit", "-m", "head")
+	headRef := git("rev-parse", "HEAD")
+
+	// A fake Codenotify binary that prints the text output, along with noise to
+	// stderr that must not be parsed.
+	binPath := filepath.Join(t.TempDir(), "codenotify")
+	require.NoError(t, os.WriteFile(binPath, []byte("#!/bin/sh\necho '@alice -> main.go'\necho 'warning: @mallory -> fake.go' >&2\n"), 0700))
+
+	var log bytes.Buffer
+	got, err := (&binaryEngine{binPath: binPath}).Run(
+		context.Background(),
+		&log,
+		engineOptions{
+			RepoPath: repoPath,
+			BaseRef:  baseRef,
+			HeadRef:  headRef,
+			Author:   "bob",
+			Filename: "CODENOTIFY",
+		},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"main.go": {"@alice"}}, got.Subscribers)
+	assert.Equal(t, []string{"README.md", "main.go"}, got.ChangedFiles, "includes changed files without subscribers")
+	assert.Contains(t, log.String(), "warning: @mallory -> fake.go", "stderr is still in the run log")
+
+	// The report is less detailed than the one of the builtin engine, which is
+	// told in the report and the run log.
+	assert.Empty(t, got.MatchedRules)
+	assert.True(t, got.RulesUnavailable)
+	assert.Contains(t, log.String(), "Matched rules are not available with the binary engine")
+}
+
+func TestParseTextOutput(t *testing.T) {
+	const output = `@alice -> internal/conf/conf.go, main.go
+@codenotify/maintainers -> main.go
+`
+	want := &codenotify.Report{
+		RulesUnavailable: true,
+		ChangedFiles:     []string{"internal/conf/conf.go", "main.go"},
+		Subscribers: map[string][]string{
+			"internal/conf/conf.go": {"@alice"},
+			"main.go":               {"@alice", "@codenotify/maintainers"},
+		},
+	}
+	assert.Equal(t, want, parseTextOutput(output))
+}
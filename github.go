@@ -5,10 +5,8 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/hmac"
-	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/hex"
@@ -17,6 +15,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"regexp"
 	"strings"
 	"time"
 
@@ -27,7 +26,12 @@ import (
 	"golang.org/x/oauth2"
 	log "unknwon.dev/clog/v2"
 
+	"github.com/codenotify/codenotify.run/internal/codenotify"
 	"github.com/codenotify/codenotify.run/internal/conf"
+	"github.com/codenotify/codenotify.run/internal/queue"
+	"github.com/codenotify/codenotify.run/internal/repoconf"
+	"github.com/codenotify/codenotify.run/internal/rundb"
+	"github.com/codenotify/codenotify.run/internal/runlog"
 )
 
 // validateGitHubWebhookSignature256 returns true if the signature matches the
@@ -46,150 +50,323 @@ func validateGitHubWebhookSignature256(signature, key string, body []byte) (bool
 	return subtle.ConstantTimeCompare([]byte(signature), []byte(got)) == 1, nil
 }
 
-func newGitHubClient(ctx context.Context, appID, installationID int64, privateKey string) (*github.Client, string, error) {
-	tr, err := ghinstallation.NewAppsTransport(http.DefaultTransport, appID, []byte(privateKey))
+// newAPIClient returns a new GitHub client that sends requests with the HTTP
+// client to GitHub.com, or to GitHub Enterprise Server when configured.
+func newAPIClient(app *githubApp, httpClient *http.Client) (*github.Client, error) {
+	if app.APIURL == "" {
+		return github.NewClient(httpClient), nil
+	}
+	return github.NewEnterpriseClient(app.APIURL, app.UploadURL, httpClient)
+}
+
+// githubWebURL returns the URL of the web interface of GitHub.com or GitHub
+// Enterprise Server, without the trailing slash.
+func githubWebURL(app *githubApp) string {
+	if app.APIURL == "" {
+		return "https://github.com"
+	}
+	apiURL, err := url.Parse(app.APIURL)
+	if err != nil {
+		// The URL has been validated when loading the configuration.
+		panic("unreachable: " + err.Error())
+	}
+	return apiURL.Scheme + "://" + apiURL.Host
+}
+
+// newAppClient returns a new GitHub client that authenticates as the GitHub
+// App itself, e.g. to list installations.
+func newAppClient(app *githubApp) (*github.Client, error) {
+	tr, err := ghinstallation.NewAppsTransport(newRateLimitTransport(http.DefaultTransport, 0), app.AppID, []byte(app.PrivateKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "new transport")
+	}
+	client, err := newAPIClient(app, &http.Client{Transport: tr})
+	if err != nil {
+		return nil, errors.Wrap(err, "new API client")
+	}
+	tr.BaseURL = strings.TrimSuffix(client.BaseURL.String(), "/")
+	return client, nil
+}
+
+// newGitHubClient returns a new GitHub client that authenticates as the
+// installation, along with the access token of the installation.
+func newGitHubClient(ctx context.Context, app *githubApp, installationID int64) (*github.Client, string, error) {
+	token, err := app.tokens.Get(ctx, installationID)
 	if err != nil {
-		return nil, "", errors.Wrap(err, "new transport")
+		return nil, "", errors.Wrap(err, "get installation access token")
 	}
 
-	client := github.NewClient(
+	client, err := newAPIClient(
+		app,
 		&http.Client{
-			Transport: tr,
+			Transport: &oauth2.Transport{
+				Source: oauth2.StaticTokenSource(
+					&oauth2.Token{
+						AccessToken: token,
+					},
+				),
+				Base: newRateLimitTransport(http.DefaultTransport, installationID),
+			},
 		},
 	)
-
-	token, _, err := client.Apps.CreateInstallationToken(ctx, installationID, nil)
 	if err != nil {
-		return nil, "", errors.Wrap(err, "create installation access token")
-	}
-	if token.Token == nil || *token.Token == "" {
-		return nil, "", errors.New("empty token returned")
+		return nil, "", errors.Wrap(err, "new API client")
 	}
+	return client, token, nil
+}
 
-	client = github.NewClient(
-		oauth2.NewClient(
-			ctx,
-			oauth2.StaticTokenSource(
-				&oauth2.Token{
-					AccessToken: *token.Token,
-				},
-			),
-		),
+type actionHandler func(ctx context.Context, config *conf.Config, w *runlog.Writer, repoConfig *repoconf.Config, payload *github.PullRequestEvent, client *github.Client, token string) (*codenotify.Report, error)
+
+// loadRepoConfig loads the per-repository configuration file from the base
+// branch of the pull request, where defaults of the GitHub App are used when the
+// file does not exist. It returns *repoconf.ValidationError if the file is
+// invalid.
+func loadRepoConfig(ctx context.Context, app *githubApp, client *github.Client, payload *github.PullRequestEvent) (*repoconf.Config, error) {
+	file, _, resp, err := client.Repositories.GetContents(
+		ctx,
+		*payload.Repo.Owner.Login,
+		*payload.Repo.Name,
+		repoconf.Path,
+		&github.RepositoryContentGetOptions{
+			Ref: *payload.PullRequest.Base.SHA,
+		},
 	)
-	return client, *token.Token, nil
-}
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		defaults := app.RepoDefaults
+		return &defaults, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "get contents")
+	} else if file == nil {
+		return nil, errors.Errorf("%q is not a file", repoconf.Path)
+	}
 
-type actionHandler func(ctx context.Context, config *conf.Config, payload *github.PullRequestEvent, client *github.Client, token string) (runID string, err error)
+	content, err := file.GetContent()
+	if err != nil {
+		return nil, errors.Wrap(err, "decode content")
+	}
+	return repoconf.Parse([]byte(content), app.RepoDefaults)
+}
 
-func reportCommitStatus(ctx context.Context, config *conf.Config, payload *github.PullRequestEvent, handler actionHandler) {
+// reportCommitStatus runs the handler for the pull request and reports the
+// outcome on the pull request. It only returns an error when the run should be
+// retried later because of rate limits, other failures are reported on the pull
+// request instead.
+func reportCommitStatus(ctx context.Context, config *conf.Config, app *githubApp, runs *runRegistry, store runlog.Store, db *rundb.DB, job *queue.Job, payload *github.PullRequestEvent, handler actionHandler) error {
 	started := time.Now()
+	trigger := jobTrigger(job)
 
-	client, token, err := newGitHubClient(ctx, config.GitHubApp.AppID, *payload.Installation.ID, config.GitHubApp.PrivateKey)
-	if err != nil {
+	client, token, err := newGitHubClient(ctx, app, *payload.Installation.ID)
+	if _, ok := rateLimitedUntil(err); ok {
+		return errors.Wrap(err, "create GitHub client")
+	} else if err != nil {
 		log.Error("Failed to create GitHub client: %v", err)
-		return
+		return nil
 	}
 
-	createStatus := func(state, description string, targetURL *string) {
-		_, _, err := client.Repositories.CreateStatus(
-			ctx,
-			*payload.Repo.Owner.Login,
-			*payload.Repo.Name,
-			*payload.PullRequest.Head.SHA,
-			&github.RepoStatus{
-				State:       github.String(state),
-				TargetURL:   targetURL,
-				Description: github.String(fmt.Sprintf("%s in %s", description, time.Since(started).Truncate(time.Millisecond))),
-				Context:     github.String("Codenotify.run"),
-			},
-		)
-		if err != nil {
-			log.Error("Failed to create commit status on pull request %s: %v", *payload.PullRequest.HTMLURL, err)
-			return
-		}
+	repoConfig, configErr := loadRepoConfig(ctx, app, client, payload)
+	var invalidConfig *repoconf.ValidationError
+	if _, ok := rateLimitedUntil(configErr); ok {
+		return errors.Wrap(configErr, "load configuration file")
+	} else if errors.As(configErr, &invalidConfig) {
+		log.Info("Invalid configuration file on pull request %s: %v", *payload.PullRequest.HTMLURL, configErr)
+	} else if configErr != nil {
+		log.Error("Failed to load configuration file for pull request %s: %v", *payload.PullRequest.HTMLURL, configErr)
+	} else if payload.PullRequest.GetDraft() && !repoConfig.NotifyOnDrafts {
+		log.Trace("Skipped draft pull request %s", *payload.PullRequest.HTMLURL)
+		return nil
+	}
+
+	// NOTE: Statuses and the run log are still saved after the run is cancelled
+	// (e.g. superseded by a newer run), thus must not use the run's context.
+	statusCtx := context.WithoutCancel(ctx)
+
+	// NOTE: The run log is created and linked from the start so that it can be
+	// followed while the run is in progress.
+	runID := runlog.NewID()
+	var w *runlog.Writer
+	var logURL string
+	if configErr == nil {
+		w = newRunLogWriter(statusCtx, app, store, runID, trigger, payload, token)
+		logURL = runLogURL(config, runID)
 	}
-	createStatus("pending", "Running Codenotify", nil)
 
-	runID, err := handler(ctx, config, payload, client, token)
-	targetURL := github.String(fmt.Sprintf("%s/runs/%s", config.Server.ExternalURL, runID))
+	reporter := newStatusReporter(app, client, payload)
+	err = reporter.Start(statusCtx, logURL)
 	if err != nil {
-		createStatus("error", "Something went wrong", targetURL)
+		log.Error("Failed to report start of the run on pull request %s: %v", *payload.PullRequest.HTMLURL, err)
+	}
+
+	var report *codenotify.Report
+	err = configErr
+	if err == nil {
+		report, err = handler(ctx, config, w, repoConfig, payload, client, token)
+	}
+	outcome := &runOutcome{
+		State:         runStateSuccess,
+		Duration:      time.Since(started),
+		LogURL:        logURL,
+		Report:        report,
+		InvalidConfig: invalidConfig,
+	}
+	_, rateLimited := rateLimitedUntil(err)
+	if invalidConfig != nil {
+		outcome.State = runStateInvalidConfig
+	} else if rateLimited {
+		outcome.State = runStateRequeued
+		log.Info("Run for pull request %s has been rate limited and will be retried: %v", *payload.PullRequest.HTMLURL, err)
+	} else if err != nil && errors.Is(context.Cause(ctx), errSuperseded) {
+		outcome.State = runStateSuperseded
+		outcome.SupersededBySameHead = runs.supersededBySameHead(pullRequestKey(payload), job.ID, payload.PullRequest.GetHead().GetSHA())
+		log.Info("Run for pull request %s has been superseded by a newer run", *payload.PullRequest.HTMLURL)
+	} else if err != nil {
+		outcome.State = runStateError
 		log.Error("Failed to run handler for pull request %s: %v", *payload.PullRequest.HTMLURL, err)
-		return
 	}
-	createStatus("success", "Codenotify ran successfully", targetURL)
+	runErr := err
+
+	record := &rundb.Run{
+		ID:             runID.String(),
+		Repository:     payload.Repo.GetFullName(),
+		RepositoryID:   payload.Repo.GetID(),
+		InstallationID: payload.Installation.GetID(),
+		PullRequest:    payload.PullRequest.GetNumber(),
+		BaseSHA:        payload.PullRequest.GetBase().GetSHA(),
+		HeadSHA:        payload.PullRequest.GetHead().GetSHA(),
+		Trigger:        trigger,
+		State:          string(outcome.State),
+		StartedAt:      started,
+		Duration:       outcome.Duration,
+	}
+	if err != nil {
+		// NOTE: Errors of commands may contain the clone URL with the token.
+		record.Error = strings.ReplaceAll(err.Error(), token, runlog.Redacted)
+	}
+	if report != nil {
+		record.Subscribers = report.Notifications()
+	}
+
+	if w != nil {
+		w.SetOutcome(string(outcome.State), report)
+		err = w.Close(statusCtx)
+		if err != nil {
+			log.Error("Failed to save run log: %v", err)
+		}
+	}
+
+	// NOTE: The requeued run is only recorded by the retry, so that the history
+	// of runs has one record per run instead of per attempt.
+	if !rateLimited {
+		err = db.CreateRun(statusCtx, record)
+		if err != nil {
+			log.Error("Failed to record run on pull request %s: %v", *payload.PullRequest.HTMLURL, err)
+		}
+	}
+
+	// NOTE: The run in progress is completed even when requeued, otherwise it is
+	// left in progress on the pull request as the retry starts a new one.
+	err = reporter.Complete(statusCtx, outcome)
+	if rateLimited {
+		if err != nil {
+			log.Error("Failed to report requeue of the run on pull request %s: %v", *payload.PullRequest.HTMLURL, err)
+		}
+		return runErr
+	} else if _, ok := rateLimitedUntil(err); ok {
+		return errors.Wrap(err, "report outcome")
+	} else if err != nil {
+		log.Error("Failed to report outcome of the run on pull request %s: %v", *payload.PullRequest.HTMLURL, err)
+	}
+	return nil
 }
 
-func logPathByRunID(rootDir, runID string) string {
-	return path.Join(rootDir, "runs", runID+".log")
+// runLogFlushInterval is the interval to save the log of a run in progress.
+const runLogFlushInterval = time.Second
+
+// newRunLogWriter returns the writer of the log of a new run for the pull
+// request, where the token is redacted.
+func newRunLogWriter(ctx context.Context, app *githubApp, store runlog.Store, runID ulid.ULID, trigger string, payload *github.PullRequestEvent, token string) *runlog.Writer {
+	return runlog.NewWriter(
+		ctx,
+		store,
+		runID,
+		&runlog.Metadata{
+			Repository:     payload.Repo.GetFullName(),
+			RepositoryID:   payload.Repo.GetID(),
+			RepositoryURL:  payload.Repo.GetHTMLURL(),
+			App:            app.Name,
+			Private:        payload.Repo.GetPrivate(),
+			InstallationID: payload.Installation.GetID(),
+			PullRequest:    payload.PullRequest.GetNumber(),
+			PullRequestURL: payload.PullRequest.GetHTMLURL(),
+			BaseSHA:        payload.PullRequest.GetBase().GetSHA(),
+			HeadSHA:        payload.PullRequest.GetHead().GetSHA(),
+			Trigger:        trigger,
+		},
+		[]string{token},
+		runLogFlushInterval,
+	)
 }
 
-func checkoutAndRun(ctx context.Context, config *conf.Config, payload *github.PullRequestEvent, token string) (output string, runID string, err error) {
+func checkoutAndRun(ctx context.Context, config *conf.Config, w *runlog.Writer, repoConfig *repoconf.Config, payload *github.PullRequestEvent, token string) (*codenotify.Report, error) {
 	tmpPath := fmt.Sprintf("tmp/repos/%s-%d", *payload.PullRequest.NodeID, time.Now().Unix())
-	err = os.MkdirAll(path.Dir(tmpPath), os.ModePerm)
+	err := os.MkdirAll(path.Dir(tmpPath), os.ModePerm)
 	if err != nil {
-		return "", "", errors.Wrap(err, "create temp directory")
+		return nil, errors.Wrap(err, "create temp directory")
 	}
 	defer func() { _ = os.RemoveAll(tmpPath) }()
 
 	cloneURL, err := url.Parse(*payload.Repo.CloneURL)
 	if err != nil {
-		return "", "", errors.Wrap(err, "parse clone URL")
+		return nil, errors.Wrap(err, "parse clone URL")
 	}
 	cloneURL.User = url.UserPassword("x-access-token", token)
 
-	// Generate a run ID and open a log file for streaming output.
-	ms := ulid.Timestamp(time.Now())
-	id, err := ulid.New(ms, rand.Reader)
+	endPhase := w.StartPhase("clone")
+	err = clone(ctx, w, tmpPath, cloneURL.String(), *payload.PullRequest.Head.SHA)
+	endPhase()
 	if err != nil {
-		return "", "", errors.Wrap(err, "generate run ID")
+		return nil, errors.Wrap(err, "clone pull request")
 	}
 
-	var buf bytes.Buffer
-	defer func() {
-		logPath := logPathByRunID(config.Server.LogsRootDir, id.String())
-		err := os.MkdirAll(path.Dir(logPath), os.ModePerm)
-		if err != nil {
-			log.Error("Failed to create log directory: %v", err)
-			return
-		}
-
-		data := bytes.ReplaceAll(buf.Bytes(), []byte(token), []byte("<REDACTED>"))
-		err = os.WriteFile(logPath, data, 0600)
-		if err != nil {
-			log.Error("Failed to write log file: %v", err)
-			return
-		}
-	}()
-
-	err = checkout(ctx, &buf, tmpPath, cloneURL.String(), *payload.PullRequest.Head.SHA, *payload.PullRequest.Commits)
+	endPhase = w.StartPhase("deepen")
+	err = deepen(ctx, w, tmpPath, *payload.PullRequest.Commits)
+	endPhase()
 	if err != nil {
-		return "", id.String(), errors.Wrap(err, "checkout pull request")
+		return nil, errors.Wrap(err, "deepen pull request")
 	}
 
-	output, err = codenotify(
+	endPhase = w.StartPhase("codenotify")
+	report, err := newEngine(config).Run(
 		ctx,
-		&buf,
-		config.Codenotify.BinPath,
-		tmpPath,
-		*payload.PullRequest.Base.SHA,
-		*payload.PullRequest.Head.SHA,
-		*payload.PullRequest.User.Login,
+		w,
+		engineOptions{
+			RepoPath:            tmpPath,
+			BaseRef:             *payload.PullRequest.Base.SHA,
+			HeadRef:             *payload.PullRequest.Head.SHA,
+			Author:              *payload.PullRequest.User.Login,
+			Filename:            repoConfig.Filename,
+			SubscriberThreshold: repoConfig.SubscriberThreshold,
+			IgnoredPaths:        repoConfig.IgnoredPaths,
+			RulesFrom:           repoConfig.RulesFrom,
+		},
 	)
+	endPhase()
 	if err != nil {
-		return "", id.String(), errors.Wrap(err, "run Codenotify")
+		return nil, errors.Wrap(err, "run Codenotify")
 	}
-	return output, id.String(), nil
+	return report, nil
 }
 
-func handlePullRequestOpen(ctx context.Context, config *conf.Config, payload *github.PullRequestEvent, client *github.Client, token string) (string, error) {
-	output, runID, err := checkoutAndRun(ctx, config, payload, token)
+func handlePullRequestOpen(ctx context.Context, config *conf.Config, w *runlog.Writer, repoConfig *repoconf.Config, payload *github.PullRequestEvent, client *github.Client, token string) (*codenotify.Report, error) {
+	report, err := checkoutAndRun(ctx, config, w, repoConfig, payload, token)
 	if err != nil {
-		return runID, errors.Wrap(err, "checkout and run")
+		return nil, errors.Wrap(err, "checkout and run")
+	} else if repoConfig.CommentStyle == repoconf.CommentStyleNone {
+		return report, nil
 	}
+	defer w.StartPhase("comment")()
 
-	if strings.Contains(output, "No notifications.") {
-		return runID, nil
+	if len(report.Subscribers) == 0 {
+		return report, nil
 	}
 
 	comment, _, err := client.Issues.CreateComment(
@@ -198,45 +375,34 @@ func handlePullRequestOpen(ctx context.Context, config *conf.Config, payload *gi
 		*payload.Repo.Name,
 		*payload.PullRequest.Number,
 		&github.IssueComment{
-			Body: github.String(output),
+			Body: github.String(renderReport(report, repoConfig.CommentStyle)),
 		},
 	)
 	if err != nil {
-		return runID, errors.Wrap(err, "create comment")
+		return report, errors.Wrap(err, "create comment")
 	}
 
 	log.Info("Created comment %s", *comment.HTMLURL)
-	return runID, nil
+	return report, nil
 }
 
-func handlePullRequestSynchronize(ctx context.Context, config *conf.Config, payload *github.PullRequestEvent, client *github.Client, token string) (string, error) {
-	output, runID, err := checkoutAndRun(ctx, config, payload, token)
+func handlePullRequestSynchronize(ctx context.Context, config *conf.Config, w *runlog.Writer, repoConfig *repoconf.Config, payload *github.PullRequestEvent, client *github.Client, token string) (*codenotify.Report, error) {
+	report, err := checkoutAndRun(ctx, config, w, repoConfig, payload, token)
 	if err != nil {
-		return runID, errors.Wrap(err, "checkout and run")
+		return nil, errors.Wrap(err, "checkout and run")
+	} else if repoConfig.CommentStyle == repoconf.CommentStyleNone {
+		return report, nil
 	}
+	defer w.StartPhase("comment")()
 
-	// Iterate over first 100 comments on the pull request and update the previous
-	// one. We don't look beyond 100 comments because it is very unlikely that the
-	// previous comment is not within the first 100 comments.
-	comments, _, err := client.Issues.ListComments(
-		ctx,
-		*payload.Repo.Owner.Login,
-		*payload.Repo.Name,
-		*payload.PullRequest.Number,
-		&github.IssueListCommentsOptions{
-			ListOptions: github.ListOptions{
-				Page:    1,
-				PerPage: 100,
-			},
-		},
-	)
+	comment, err := findReportComment(ctx, client, payload)
 	if err != nil {
-		return runID, errors.Wrap(err, "list comments")
+		return report, errors.Wrap(err, "find report comment")
 	}
-
-	for _, comment := range comments {
-		if comment.Body == nil || !strings.Contains(*comment.Body, `<!-- codenotify:CODENOTIFY report -->`) {
-			continue
+	if comment != nil {
+		if strings.Contains(comment.GetBody(), mutedMarker) {
+			log.Info("Skipped editing muted comment %s", comment.GetHTMLURL())
+			return report, nil
 		}
 
 		_, _, err = client.Issues.EditComment(
@@ -245,33 +411,79 @@ func handlePullRequestSynchronize(ctx context.Context, config *conf.Config, payl
 			*payload.Repo.Name,
 			*comment.ID,
 			&github.IssueComment{
-				Body: github.String(output),
+				Body: github.String(renderReport(report, repoConfig.CommentStyle)),
 			},
 		)
 		if err != nil {
-			return runID, errors.Wrap(err, "edit comment")
+			return report, errors.Wrap(err, "edit comment")
 		}
 		log.Info("Edited comment %s", *comment.HTMLURL)
-		return runID, nil
+		return report, nil
 	}
 
-	if strings.Contains(output, "No notifications.") {
-		return runID, nil
+	if len(report.Subscribers) == 0 {
+		return report, nil
 	}
 
-	comment, _, err := client.Issues.CreateComment(
+	comment, _, err = client.Issues.CreateComment(
 		ctx,
 		*payload.Repo.Owner.Login,
 		*payload.Repo.Name,
 		*payload.PullRequest.Number,
 		&github.IssueComment{
-			Body: github.String(output),
+			Body: github.String(renderReport(report, repoConfig.CommentStyle)),
 		},
 	)
 	if err != nil {
-		return runID, errors.Wrap(err, "create comment")
+		return report, errors.Wrap(err, "create comment")
 	}
 
 	log.Info("Created comment %s", *comment.HTMLURL)
-	return runID, nil
+	return report, nil
+}
+
+// renderReport renders the report in Markdown with the comment style.
+func renderReport(report *codenotify.Report, style string) string {
+	if style == repoconf.CommentStyleList {
+		return report.MarkdownList()
+	}
+	return report.Markdown()
+}
+
+var (
+	// reportMarkerRegexp matches the marker that Codenotify puts in its report,
+	// regardless of the name of files that contain rules.
+	reportMarkerRegexp = regexp.MustCompile(`<!-- codenotify:\S+ report -->`)
+)
+
+// mutedMarker is the marker in the report comment of a muted pull request.
+const mutedMarker = `<!-- codenotify.run:muted -->`
+
+// findReportComment returns the comment with the Codenotify report on the pull
+// request, or nil if not found. It iterates over first 100 comments on the pull
+// request because it is very unlikely that the previous report is not within
+// the first 100 comments.
+func findReportComment(ctx context.Context, client *github.Client, payload *github.PullRequestEvent) (*github.IssueComment, error) {
+	comments, _, err := client.Issues.ListComments(
+		ctx,
+		*payload.Repo.Owner.Login,
+		*payload.Repo.Name,
+		*payload.PullRequest.Number,
+		&github.IssueListCommentsOptions{
+			ListOptions: github.ListOptions{
+				Page:    1,
+				PerPage: 100,
+			},
+		},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "list comments")
+	}
+
+	for _, comment := range comments {
+		if reportMarkerRegexp.MatchString(comment.GetBody()) {
+			return comment, nil
+		}
+	}
+	return nil, nil
 }
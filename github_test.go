@@ -5,9 +5,30 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/go-github/v45/github"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codenotify/codenotify.run/internal/codenotify"
+	"github.com/codenotify/codenotify.run/internal/conf"
+	"github.com/codenotify/codenotify.run/internal/queue"
+	"github.com/codenotify/codenotify.run/internal/repoconf"
+	"github.com/codenotify/codenotify.run/internal/rundb"
+	"github.com/codenotify/codenotify.run/internal/runlog"
 )
 
 func TestValidateGitHubWebhookSignature256(t *testing.T) {
@@ -44,3 +65,135 @@ func TestValidateGitHubWebhookSignature256(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestGitHubEnterpriseServer(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	// A fake GitHub Enterprise Server that serves the API under "/api/v3/".
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v3/app/installations/1/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ey") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"token":"ghs_enterprise","expires_at":"` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`))
+	})
+	mux.HandleFunc("GET /api/v3/repos/codenotify/codenotify.run", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ghs_enterprise" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"full_name":"codenotify/codenotify.run"}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	apps := newGitHubApps(
+		&conf.Config{
+			GitHubApps: []*conf.GitHubApp{
+				{
+					Name:       conf.DefaultGitHubApp,
+					AppID:      1,
+					PrivateKey: string(privateKey),
+					APIURL:     server.URL + "/api/v3/",
+					UploadURL:  server.URL + "/api/uploads/",
+				},
+			},
+		},
+	)
+	app := apps[0]
+
+	ctx := context.Background()
+	client, token, err := newGitHubClient(ctx, app, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "ghs_enterprise", token)
+	assert.Equal(t, server.URL+"/api/v3/", client.BaseURL.String())
+	assert.Equal(t, server.URL+"/api/uploads/", client.UploadURL.String())
+
+	repo, _, err := client.Repositories.Get(ctx, "codenotify", "codenotify.run")
+	require.NoError(t, err)
+	assert.Equal(t, "codenotify/codenotify.run", repo.GetFullName())
+
+	assert.Equal(t, server.URL, githubWebURL(app))
+	assert.Equal(t, server.URL+"/login/oauth/authorize", oauthEndpoint(app).AuthURL)
+
+	// GitHub.com is used by default.
+	app.APIURL = ""
+	app.UploadURL = ""
+	client, err = newAppClient(app)
+	require.NoError(t, err)
+	assert.Equal(t, "https://api.github.com/", client.BaseURL.String())
+	assert.Equal(t, "https://github.com", githubWebURL(app))
+}
+
+func TestReportCommitStatus_RateLimited(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db, err := rundb.Open(ctx, rundb.TypeSQLite, filepath.Join(dir, "codenotify.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	store := runlog.NewFileStore(filepath.Join(dir, "runs"))
+
+	var completed github.UpdateCheckRunOptions
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v3/repos/codenotify/codenotify.run/contents/.github/codenotify.yml", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	mux.HandleFunc("POST /api/v3/repos/codenotify/codenotify.run/check-runs", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id":1}`))
+	})
+	mux.HandleFunc("PATCH /api/v3/repos/codenotify/codenotify.run/check-runs/1", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&completed)
+		_, _ = w.Write([]byte(`{"id":1}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	app := &githubApp{
+		GitHubApp: &conf.GitHubApp{
+			Name:      conf.DefaultGitHubApp,
+			APIURL:    server.URL + "/api/v3/",
+			UploadURL: server.URL + "/api/uploads/",
+			Reporter:  conf.ReporterChecks,
+		},
+		tokens: newTokenCache(func(context.Context, int64) (string, time.Time, error) {
+			return "token", time.Now().Add(time.Hour), nil
+		}),
+	}
+	payload := &github.PullRequestEvent{
+		Installation: &github.Installation{ID: github.Int64(1)},
+		Repo: &github.Repository{
+			ID:       github.Int64(1),
+			FullName: github.String("codenotify/codenotify.run"),
+			Owner:    &github.User{Login: github.String("codenotify")},
+			Name:     github.String("codenotify.run"),
+		},
+		PullRequest: &github.PullRequest{
+			Number:  github.Int(1),
+			HTMLURL: github.String("https://github.com/codenotify/codenotify.run/pull/1"),
+			Base:    &github.PullRequestBranch{SHA: github.String("base")},
+			Head:    &github.PullRequestBranch{SHA: github.String("head")},
+		},
+	}
+	handler := func(context.Context, *conf.Config, *runlog.Writer, *repoconf.Config, *github.PullRequestEvent, *github.Client, string) (*codenotify.Report, error) {
+		req := httptest.NewRequest(http.MethodGet, "/repos/codenotify/codenotify.run/pulls/1/files", nil)
+		return nil, errors.Wrap(&github.AbuseRateLimitError{
+			Response: &http.Response{Request: req, StatusCode: http.StatusForbidden},
+			Message:  "You have exceeded a secondary rate limit",
+		}, "list files")
+	}
+	job := &queue.Job{ID: "01A", Event: "pull_request", Payload: []byte(`{"action":"synchronize"}`)}
+	err = reportCommitStatus(ctx, &conf.Config{}, app, newRunRegistry(), store, db, job, payload, handler)
+	_, limited := rateLimitedUntil(err)
+	assert.True(t, limited, "returns the error to be requeued")
+
+	// The check run in progress is completed, and the retry records the run.
+	assert.Equal(t, "completed", completed.GetStatus())
+	assert.Equal(t, "neutral", completed.GetConclusion())
+	runs, err := db.ListRuns(ctx, rundb.ListRunsOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, runs)
+}
@@ -0,0 +1,449 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package codenotify implements the rules of Codenotify, which lets people
+// subscribe to file changes via CODENOTIFY files, see
+// https://github.com/sourcegraph/codenotify#codenotify-files.
+package codenotify
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Options contains the options to match changed files against rules.
+type Options struct {
+	// Filename is the name of files that contain rules, e.g. "CODENOTIFY".
+	Filename string
+	// Author is the subscriber (e.g. "@alice") that is the author of changes,
+	// who never gets notified.
+	Author string
+	// SubscriberThreshold is the maximum number of subscribers to be notified, 0
+	// means no limit.
+	SubscriberThreshold int
+	// IgnoredPaths is the list of patterns of files that are never matched
+	// against rules, e.g. "**/*_test.go".
+	IgnoredPaths []string
+}
+
+// Report is the structured result of matching changed files against rules.
+type Report struct {
+	// Filename is the name of files that contain rules.
+	Filename string `json:"filename"`
+	// BaseRef and HeadRef are the refs that changes are between.
+	BaseRef string `json:"base_ref"`
+	HeadRef string `json:"head_ref"`
+	// ChangedFiles is the list of all changed files.
+	ChangedFiles []string `json:"changed_files"`
+	// IgnoredFiles is the list of changed files that matched ignored paths and
+	// thus were not matched against rules.
+	IgnoredFiles []string `json:"ignored_files,omitempty"`
+	// ModifiedRuleFiles is the list of changed files that are rule files, which
+	// deserves attention because changes may alter who gets notified.
+	ModifiedRuleFiles []string `json:"modified_rule_files,omitempty"`
+	// MatchedRules is the list of rules that matched at least one changed file,
+	// ordered by paths of rule files and lines within a file.
+	MatchedRules []*Rule `json:"matched_rules"`
+	// RulesUnavailable indicates that matched rules are unknown, e.g. the report
+	// is parsed from the text output of the Codenotify binary.
+	RulesUnavailable bool `json:"rules_unavailable,omitempty"`
+	// Subscribers maps changed files to their subscribers, files without any
+	// subscriber are omitted.
+	Subscribers map[string][]string `json:"subscribers"`
+	// SubscriberThreshold is the maximum number of subscribers to be notified, 0
+	// means no limit.
+	SubscriberThreshold int `json:"subscriber_threshold"`
+	// ThresholdExceeded indicates whether the number of subscribers has exceeded
+	// the subscriber threshold, in which case nobody should be notified.
+	ThresholdExceeded bool `json:"threshold_exceeded"`
+	// OverThreshold is the list of subscribers that are not notified because the
+	// subscriber threshold has been exceeded, which may be empty when the report
+	// is parsed from an output that does not contain such information.
+	OverThreshold []string `json:"over_threshold,omitempty"`
+}
+
+// Rule is a rule that matched changed files.
+type Rule struct {
+	// Revision is the name of the revision that the rule is read from, e.g.
+	// "base", it is empty when not specified.
+	Revision string `json:"revision,omitempty"`
+	// Source is the path of the rule file.
+	Source string `json:"source"`
+	// Line is the line number of the rule in the rule file.
+	Line int `json:"line"`
+	// Pattern is the pattern of the rule, relative to the directory of the rule
+	// file.
+	Pattern string `json:"pattern"`
+	// Subscribers is the list of subscribers of the rule.
+	Subscribers []string `json:"subscribers"`
+	// Files is the list of changed files that matched the rule.
+	Files []string `json:"files"`
+}
+
+// Location returns the location of the rule in the form of "source:line",
+// followed by the revision in parentheses if available.
+func (r *Rule) Location() string {
+	if r.Revision == "" {
+		return fmt.Sprintf("%s:%d", r.Source, r.Line)
+	}
+	return fmt.Sprintf("%s:%d (%s)", r.Source, r.Line, r.Revision)
+}
+
+// Notifications returns subscribers mapped to files they are notified for,
+// with files sorted. It returns an empty map if the subscriber threshold has
+// been exceeded.
+func (r *Report) Notifications() map[string][]string {
+	notifications := make(map[string][]string)
+	if r.ThresholdExceeded {
+		return notifications
+	}
+	for file, subscribers := range r.Subscribers {
+		for _, subscriber := range subscribers {
+			notifications[subscriber] = append(notifications[subscriber], file)
+		}
+	}
+	for _, files := range notifications {
+		sort.Strings(files)
+	}
+	return notifications
+}
+
+// Revision is a revision of the repository that rules are read from.
+type Revision struct {
+	// Name is the name of the revision, e.g. "base", which is recorded in matched
+	// rules.
+	Name string
+	// FS is the file system of the root of the repository at the revision.
+	FS fs.FS
+}
+
+// Match matches changed files against rules in the file system, which is
+// typically the root of a repository. The BaseRef and HeadRef of the returned
+// report are left for the caller to fill.
+func Match(fsys fs.FS, files []string, opts Options) (*Report, error) {
+	return MatchRevisions([]Revision{{FS: fsys}}, files, opts)
+}
+
+// MatchRevisions is like Match but matches changed files against the union of
+// rules in all the revisions. Rules with the same pattern and subscribers in
+// the same directory are only taken from the first revision that has them.
+func MatchRevisions(revisions []Revision, files []string, opts Options) (*Report, error) {
+	ignored, err := compilePatterns(opts.IgnoredPaths)
+	if err != nil {
+		return nil, errors.Wrap(err, "compile ignored paths")
+	}
+
+	m := &matcher{
+		revisions: revisions,
+		opts:      opts,
+		cache:     make(map[string][]*rule),
+	}
+	report := &Report{
+		Filename:            opts.Filename,
+		ChangedFiles:        files,
+		ModifiedRuleFiles:   RuleFiles(files, opts.Filename),
+		Subscribers:         make(map[string][]string),
+		SubscriberThreshold: opts.SubscriberThreshold,
+	}
+	for _, file := range files {
+		if matchAny(ignored, file) {
+			report.IgnoredFiles = append(report.IgnoredFiles, file)
+			continue
+		}
+
+		subscribers, err := m.matchFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "match %q", file)
+		}
+		if len(subscribers) > 0 {
+			report.Subscribers[file] = subscribers
+		}
+	}
+
+	// Collect matched rules in a stable order.
+	sort.Strings(m.dirs)
+	for _, dir := range m.dirs {
+		for _, r := range m.cache[dir] {
+			if len(r.files) == 0 {
+				continue
+			}
+			report.MatchedRules = append(report.MatchedRules, &Rule{
+				Revision:    r.revision,
+				Source:      r.source,
+				Line:        r.line,
+				Pattern:     r.pattern,
+				Subscribers: r.subscribers,
+				Files:       r.files,
+			})
+		}
+	}
+
+	report.checkThreshold()
+	return report, nil
+}
+
+// RuleFiles returns files that are rule files with the given name.
+func RuleFiles(files []string, filename string) []string {
+	var ruleFiles []string
+	for _, file := range files {
+		if path.Base(file) == filename {
+			ruleFiles = append(ruleFiles, file)
+		}
+	}
+	return ruleFiles
+}
+
+// Ignore removes changed files that match any of the patterns from
+// subscribers of the report, and records them as ignored files. It is useful
+// when the report is not produced by Match, and the subscriber threshold is
+// checked again against subscribers of remaining files.
+func (r *Report) Ignore(patterns []string) error {
+	ignored, err := compilePatterns(patterns)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range r.ChangedFiles {
+		if matchAny(ignored, file) {
+			r.IgnoredFiles = append(r.IgnoredFiles, file)
+			delete(r.Subscribers, file)
+		}
+	}
+	r.checkThreshold()
+	return nil
+}
+
+// checkThreshold sets whether the number of subscribers has exceeded the
+// subscriber threshold.
+func (r *Report) checkThreshold() {
+	r.ThresholdExceeded = false
+	r.OverThreshold = nil
+
+	subscribers := make(map[string]struct{})
+	for _, subs := range r.Subscribers {
+		for _, sub := range subs {
+			subscribers[sub] = struct{}{}
+		}
+	}
+	if r.SubscriberThreshold > 0 && len(subscribers) > r.SubscriberThreshold {
+		r.ThresholdExceeded = true
+		for sub := range subscribers {
+			r.OverThreshold = append(r.OverThreshold, sub)
+		}
+		sort.Strings(r.OverThreshold)
+	}
+}
+
+// matcher matches files against rules with rule files cached by directories.
+type matcher struct {
+	revisions []Revision
+	opts      Options
+	cache     map[string][]*rule // Directory -> rules
+	dirs      []string           // Directories that have been loaded
+}
+
+// loadRules loads and deduplicates rules in the directory of all revisions.
+func (m *matcher) loadRules(dir string) ([]*rule, error) {
+	var rules []*rule
+	seen := make(map[string]bool)
+	for _, rev := range m.revisions {
+		revRules, err := loadRules(rev.FS, path.Join(dir, m.opts.Filename))
+		if err != nil {
+			if rev.Name != "" {
+				return nil, errors.Wrapf(err, "revision %q", rev.Name)
+			}
+			return nil, err
+		}
+		for _, r := range revRules {
+			key := r.pattern + " " + strings.Join(r.subscribers, " ")
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			r.revision = rev.Name
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// matchFile returns subscribers of the file, which are collected from rule
+// files in every directory from the root to the directory of the file.
+func (m *matcher) matchFile(file string) ([]string, error) {
+	seen := make(map[string]bool)
+	var subscribers []string
+
+	dirs := []string{"."}
+	parts := strings.Split(path.Dir(file), "/")
+	for i := range parts {
+		if parts[i] == "." {
+			continue
+		}
+		dirs = append(dirs, path.Join(parts[:i+1]...))
+	}
+
+	for _, dir := range dirs {
+		rules, ok := m.cache[dir]
+		if !ok {
+			var err error
+			rules, err = m.loadRules(dir)
+			if err != nil {
+				return nil, err
+			}
+			m.cache[dir] = rules
+			m.dirs = append(m.dirs, dir)
+		}
+
+		rel := file
+		if dir != "." {
+			rel = strings.TrimPrefix(file, dir+"/")
+		}
+		for _, r := range rules {
+			if !r.re.MatchString(rel) {
+				continue
+			}
+			r.files = append(r.files, file)
+
+			for _, subscriber := range r.subscribers {
+				if subscriber == m.opts.Author || seen[subscriber] {
+					continue
+				}
+				seen[subscriber] = true
+				subscribers = append(subscribers, subscriber)
+			}
+		}
+	}
+	sort.Strings(subscribers)
+	return subscribers, nil
+}
+
+// rule is a line in a rule file.
+type rule struct {
+	revision    string
+	source      string
+	line        int
+	pattern     string
+	re          *regexp.Regexp
+	subscribers []string
+	files       []string // Matched files
+}
+
+// loadRules loads rules from the rule file. It returns nil if the file does
+// not exist.
+func loadRules(fsys fs.FS, name string) ([]*rule, error) {
+	f, err := fsys.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "open")
+	}
+	defer func() { _ = f.Close() }()
+
+	var rules []*rule
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, errors.Errorf("%s:%d: expect at least two fields but got %q", name, line, text)
+		}
+
+		re, err := compilePattern(fields[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d: compile pattern %q", name, line, fields[0])
+		}
+		rules = append(rules, &rule{
+			source:      name,
+			line:        line,
+			pattern:     fields[0],
+			re:          re,
+			subscribers: fields[1:],
+		})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "scan")
+	}
+	return rules, nil
+}
+
+// ValidatePattern returns an error if the pattern is not a valid pattern of
+// paths.
+func ValidatePattern(pattern string) error {
+	if strings.TrimSpace(pattern) == "" {
+		return errors.New("empty pattern")
+	} else if strings.HasPrefix(pattern, "/") {
+		return errors.New("pattern must be relative to the root")
+	}
+	_, err := compilePattern(pattern)
+	return err
+}
+
+// compilePatterns compiles all the patterns.
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		if err := ValidatePattern(pattern); err != nil {
+			return nil, errors.Wrapf(err, "pattern %q", pattern)
+		}
+		re, err := compilePattern(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "compile pattern %q", pattern)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// matchAny returns true if the path matches any of the regular expressions.
+func matchAny(res []*regexp.Regexp, path string) bool {
+	for _, re := range res {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// compilePattern compiles the glob pattern to a regular expression, where "*"
+// matches any sequence of characters except "/", "?" matches any single
+// character except "/", and "**" matches any sequence of characters including
+// "/", e.g. "**/*.md" matches "README.md" and "docs/README.md".
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					// "**/" also matches zero directories.
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,251 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package codenotify
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompilePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{pattern: "file.md", path: "file.md", want: true},
+		{pattern: "file.md", path: "dir/file.md", want: false},
+		{pattern: "*.md", path: "README.md", want: true},
+		{pattern: "*.md", path: "docs/README.md", want: false},
+		{pattern: "**/*.md", path: "README.md", want: true},
+		{pattern: "**/*.md", path: "docs/dev/README.md", want: true},
+		{pattern: "dir/*", path: "dir/file.go", want: true},
+		{pattern: "dir/*", path: "dir/sub/file.go", want: false},
+		{pattern: "dir/**", path: "dir/sub/file.go", want: true},
+		{pattern: "?.go", path: "a.go", want: true},
+		{pattern: "?.go", path: "ab.go", want: false},
+		{pattern: "file+1.go", path: "file+1.go", want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern+" "+test.path, func(t *testing.T) {
+			re, err := compilePattern(test.pattern)
+			require.NoError(t, err)
+			assert.Equal(t, test.want, re.MatchString(test.path))
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	fsys := fstest.MapFS{
+		"CODENOTIFY": &fstest.MapFile{Data: []byte(`
+# Root rules
+**/*.md @docs
+go.mod  @alice @bob
+`)},
+		"internal/CODENOTIFY": &fstest.MapFile{Data: []byte(`
+conf/** @alice
+*.go    @codenotify/maintainers
+`)},
+	}
+
+	t.Run("match", func(t *testing.T) {
+		got, err := Match(
+			fsys,
+			[]string{"README.md", "go.mod", "internal/conf/conf.go", "internal/conf/README.md", "main.go"},
+			Options{
+				Filename: "CODENOTIFY",
+				Author:   "@bob",
+			},
+		)
+		require.NoError(t, err)
+
+		want := &Report{
+			Filename:     "CODENOTIFY",
+			ChangedFiles: []string{"README.md", "go.mod", "internal/conf/conf.go", "internal/conf/README.md", "main.go"},
+			MatchedRules: []*Rule{
+				{
+					Source:      "CODENOTIFY",
+					Line:        3,
+					Pattern:     "**/*.md",
+					Subscribers: []string{"@docs"},
+					Files:       []string{"README.md", "internal/conf/README.md"},
+				},
+				{
+					Source:      "CODENOTIFY",
+					Line:        4,
+					Pattern:     "go.mod",
+					Subscribers: []string{"@alice", "@bob"},
+					Files:       []string{"go.mod"},
+				},
+				{
+					Source:      "internal/CODENOTIFY",
+					Line:        2,
+					Pattern:     "conf/**",
+					Subscribers: []string{"@alice"},
+					Files:       []string{"internal/conf/conf.go", "internal/conf/README.md"},
+				},
+			},
+			Subscribers: map[string][]string{
+				"README.md":               {"@docs"},
+				"go.mod":                  {"@alice"},
+				"internal/conf/conf.go":   {"@alice"},
+				"internal/conf/README.md": {"@alice", "@docs"},
+			},
+		}
+		assert.Equal(t, want, got)
+		assert.Equal(t,
+			map[string][]string{
+				"@alice": {"go.mod", "internal/conf/README.md", "internal/conf/conf.go"},
+				"@docs":  {"README.md", "internal/conf/README.md"},
+			},
+			got.Notifications(),
+		)
+	})
+
+	t.Run("threshold exceeded", func(t *testing.T) {
+		got, err := Match(
+			fsys,
+			[]string{"README.md", "go.mod"},
+			Options{
+				Filename:            "CODENOTIFY",
+				SubscriberThreshold: 2,
+			},
+		)
+		require.NoError(t, err)
+		assert.True(t, got.ThresholdExceeded)
+		assert.Equal(t, []string{"@alice", "@bob", "@docs"}, got.OverThreshold)
+		assert.Empty(t, got.Notifications())
+	})
+
+	t.Run("ignored paths", func(t *testing.T) {
+		got, err := Match(
+			fsys,
+			[]string{"README.md", "go.mod", "internal/conf/README.md"},
+			Options{
+				Filename:     "CODENOTIFY",
+				IgnoredPaths: []string{"**/*.md"},
+			},
+		)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"README.md", "internal/conf/README.md"}, got.IgnoredFiles)
+		assert.Equal(t, map[string][]string{"go.mod": {"@alice", "@bob"}}, got.Subscribers)
+	})
+
+	t.Run("modified rule files", func(t *testing.T) {
+		got, err := Match(
+			fsys,
+			[]string{"CODENOTIFY", "internal/CODENOTIFY", "internal/CODENOTIFY.md"},
+			Options{Filename: "CODENOTIFY"},
+		)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"CODENOTIFY", "internal/CODENOTIFY"}, got.ModifiedRuleFiles)
+	})
+
+	t.Run("malformed rule", func(t *testing.T) {
+		_, err := Match(
+			fstest.MapFS{"CODENOTIFY": &fstest.MapFile{Data: []byte("README.md\n")}},
+			[]string{"README.md"},
+			Options{Filename: "CODENOTIFY"},
+		)
+		assert.ErrorContains(t, err, "CODENOTIFY:1: expect at least two fields")
+	})
+}
+
+func TestMatchRevisions(t *testing.T) {
+	base := fstest.MapFS{
+		"CODENOTIFY": &fstest.MapFile{Data: []byte("*.go @alice\n*.md @docs\n")},
+	}
+	// The head removes "@alice" and adds "@bob".
+	head := fstest.MapFS{
+		"CODENOTIFY": &fstest.MapFile{Data: []byte("*.md @docs\n*.go @bob\n")},
+	}
+
+	got, err := MatchRevisions(
+		[]Revision{{Name: "base", FS: base}, {Name: "head", FS: head}},
+		[]string{"main.go", "README.md"},
+		Options{Filename: "CODENOTIFY"},
+	)
+	require.NoError(t, err)
+
+	want := []*Rule{
+		{Revision: "base", Source: "CODENOTIFY", Line: 1, Pattern: "*.go", Subscribers: []string{"@alice"}, Files: []string{"main.go"}},
+		{Revision: "base", Source: "CODENOTIFY", Line: 2, Pattern: "*.md", Subscribers: []string{"@docs"}, Files: []string{"README.md"}},
+		{Revision: "head", Source: "CODENOTIFY", Line: 2, Pattern: "*.go", Subscribers: []string{"@bob"}, Files: []string{"main.go"}},
+	}
+	assert.Equal(t, want, got.MatchedRules)
+	assert.Equal(t,
+		map[string][]string{
+			"main.go":   {"@alice", "@bob"},
+			"README.md": {"@docs"},
+		},
+		got.Subscribers,
+	)
+	assert.Equal(t, "CODENOTIFY:2 (head)", got.MatchedRules[2].Location())
+}
+
+func TestReport_Ignore(t *testing.T) {
+	r := &Report{
+		ChangedFiles: []string{"README.md", "docs/index.md", "go.mod"},
+		Subscribers: map[string][]string{
+			"README.md":     {"@docs"},
+			"docs/index.md": {"@docs", "@alice"},
+			"go.mod":        {"@alice"},
+		},
+		SubscriberThreshold: 1,
+	}
+	r.checkThreshold()
+	assert.True(t, r.ThresholdExceeded)
+
+	require.NoError(t, r.Ignore([]string{"**/*.md"}))
+	assert.Equal(t, []string{"README.md", "docs/index.md"}, r.IgnoredFiles)
+	assert.Equal(t, map[string][]string{"go.mod": {"@alice"}}, r.Subscribers)
+	assert.False(t, r.ThresholdExceeded)
+
+	assert.Error(t, r.Ignore([]string{"/README.md"}))
+}
+
+func TestReport_Markdown(t *testing.T) {
+	r := &Report{
+		Filename: "CODENOTIFY",
+		BaseRef:  "07da1e1",
+		HeadRef:  "5a96148",
+		Subscribers: map[string][]string{
+			"README.md": {"@docs"},
+			"go.mod":    {"@alice", "@docs"},
+		},
+	}
+	want := `<!-- codenotify:CODENOTIFY report -->
+[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in CODENOTIFY files for diff 07da1e1...5a96148.
+
+| Notify | File(s) |
+|-|-|
+| @alice | go.mod |
+| @docs | README.md<br>go.mod |
+`
+	assert.Equal(t, want, r.Markdown())
+
+	r.SubscriberThreshold = 1
+	r.ThresholdExceeded = true
+	r.OverThreshold = []string{"@alice", "@docs"}
+	assert.Equal(t, "<!-- codenotify:CODENOTIFY report -->\nNot notifying subscribers because the number of notifying subscribers has exceeded the threshold (1).\n", r.Markdown())
+
+	r.ThresholdExceeded = false
+	wantList := `<!-- codenotify:CODENOTIFY report -->
+[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in CODENOTIFY files for diff 07da1e1...5a96148.
+
+- @alice: ` + "`go.mod`" + `
+- @docs: ` + "`README.md`, `go.mod`" + `
+`
+	assert.Equal(t, wantList, r.MarkdownList())
+
+	r = &Report{Filename: "CODENOTIFY", Subscribers: map[string][]string{}}
+	assert.Equal(t, "<!-- codenotify:CODENOTIFY report -->\nNo notifications.\n", r.Markdown())
+
+	r.ModifiedRuleFiles = []string{"CODENOTIFY", "docs/CODENOTIFY"}
+	assert.Equal(t, "<!-- codenotify:CODENOTIFY report -->\n> **Note**\n> This pull request modifies CODENOTIFY files: `CODENOTIFY`, `docs/CODENOTIFY`.\n\nNo notifications.\n", r.Markdown())
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package codenotify
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ReportMarker returns the marker that the report of rules in files with the
+// given name starts with.
+func ReportMarker(filename string) string {
+	return fmt.Sprintf("<!-- codenotify:%s report -->", filename)
+}
+
+// Markdown renders the report in the same Markdown format as the report of
+// the upstream Codenotify.
+func (r *Report) Markdown() string {
+	return r.markdown(func(b *strings.Builder, subscribers []string, notifications map[string][]string) {
+		b.WriteString("| Notify | File(s) |\n")
+		b.WriteString("|-|-|\n")
+		for _, subscriber := range subscribers {
+			_, _ = fmt.Fprintf(b, "| %s | %s |\n", subscriber, strings.Join(notifications[subscriber], "<br>"))
+		}
+	})
+}
+
+// MarkdownList renders the report in Markdown with a bulleted list of
+// subscribers, which is more compact than the table for long file paths.
+func (r *Report) MarkdownList() string {
+	return r.markdown(func(b *strings.Builder, subscribers []string, notifications map[string][]string) {
+		for _, subscriber := range subscribers {
+			_, _ = fmt.Fprintf(b, "- %s: `%s`\n", subscriber, strings.Join(notifications[subscriber], "`, `"))
+		}
+	})
+}
+
+// markdown renders the report in Markdown with the given function to render
+// subscribers to be notified in sorted order.
+func (r *Report) markdown(render func(b *strings.Builder, subscribers []string, notifications map[string][]string)) string {
+	var b strings.Builder
+	b.WriteString(ReportMarker(r.Filename))
+	b.WriteString("\n")
+	if len(r.ModifiedRuleFiles) > 0 {
+		_, _ = fmt.Fprintf(&b, "> **Note**\n> This pull request modifies %s files: `%s`.\n\n", r.Filename, strings.Join(r.ModifiedRuleFiles, "`, `"))
+	}
+
+	if r.ThresholdExceeded {
+		_, _ = fmt.Fprintf(&b, "Not notifying subscribers because the number of notifying subscribers has exceeded the threshold (%d).\n", r.SubscriberThreshold)
+		return b.String()
+	}
+
+	notifications := r.Notifications()
+	if len(notifications) == 0 {
+		b.WriteString("No notifications.\n")
+		return b.String()
+	}
+
+	subscribers := make([]string, 0, len(notifications))
+	for subscriber := range notifications {
+		subscribers = append(subscribers, subscriber)
+	}
+	sort.Strings(subscribers)
+
+	_, _ = fmt.Fprintf(&b, "[Codenotify](https://github.com/sourcegraph/codenotify): Notifying subscribers in %s files for diff %s...%s.\n\n", r.Filename, r.BaseRef, r.HeadRef)
+	render(&b, subscribers, notifications)
+	return b.String()
+}
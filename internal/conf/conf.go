@@ -5,12 +5,15 @@
 package conf
 
 import (
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/go-ini/ini"
 	"github.com/pkg/errors"
 
 	"github.com/codenotify/codenotify.run/conf"
+	"github.com/codenotify/codenotify.run/internal/repoconf"
 )
 
 // Build time and commit information.
@@ -21,29 +24,144 @@ var (
 	BuildCommit string
 )
 
+// The available values of "[github_app] REPORTER".
+const (
+	// ReporterChecks reports runs with the Checks API.
+	ReporterChecks = "checks"
+	// ReporterStatuses reports runs with commit statuses.
+	ReporterStatuses = "statuses"
+)
+
+// The available values of "[codenotify] ENGINE".
+const (
+	// EngineBuiltin runs Codenotify in-process.
+	EngineBuiltin = "builtin"
+	// EngineBinary runs Codenotify via its binary.
+	EngineBinary = "binary"
+)
+
+// The available values of "[server] LOGS_STORAGE".
+const (
+	// LogsStorageLocal stores run logs in "[server] LOGS_ROOT_DIR".
+	LogsStorageLocal = "local"
+	// LogsStorageS3 stores run logs in the S3-compatible object storage
+	// configured in "[s3]".
+	LogsStorageS3 = "s3"
+)
+
+// The available values of "[database] TYPE".
+const (
+	// DatabaseSQLite stores run history in the SQLite database at "[database]
+	// PATH".
+	DatabaseSQLite = "sqlite"
+	// DatabasePostgres stores run history in the PostgreSQL database of
+	// "[database] DSN".
+	DatabasePostgres = "postgres"
+)
+
 // Config contains all the configuration.
 type Config struct {
 	// Server contains the server configuration.
 	Server struct {
 		ExternalURL string `ini:"EXTERNAL_URL"`
 		LogsRootDir string
+		LogsStorage string
+	}
+	// S3 contains the S3-compatible object storage configuration.
+	S3 struct {
+		Endpoint        string
+		Region          string
+		Bucket          string
+		AccessKeyID     string `ini:"ACCESS_KEY_ID"`
+		SecretAccessKey string
+		UseSSL          bool `ini:"USE_SSL"`
+		Prefix          string
+	}
+	// Database contains the database configuration of run history.
+	Database struct {
+		Type string
+		Path string
+		DSN  string `ini:"DSN"`
 	}
-	// GitHubApp contains the GitHub App configuration.
-	GitHubApp struct {
-		AppID         int64  `ini:"APP_ID"`
-		ClientID      string `ini:"CLIENT_ID"`
-		ClientSecret  string
-		PrivateKey    string
-		WebhookSecret string
+	// Admin contains the administration configuration.
+	Admin struct {
+		Token string
 	}
-	// Codenotify contains the Codenotify configuration.
+	// GitHubApps contains the configuration of GitHub Apps, where the first one
+	// is the default app of "[github_app]", followed by the ones of
+	// "[github_app.<name>]" sections.
+	GitHubApps []*GitHubApp `ini:"-"`
+	// Queue contains the job queue configuration.
+	Queue struct {
+		Path                    string
+		Concurrency             int
+		InstallationConcurrency int
+		DeliveryTTL             time.Duration `ini:"DELIVERY_TTL"`
+	}
+	// Retention contains the retention policy of run logs.
+	Retention struct {
+		Interval             time.Duration
+		MaxAge               time.Duration
+		MaxTotalSizeMB       int64 `ini:"MAX_TOTAL_SIZE_MB"`
+		MaxRunsPerRepository int
+	}
+	// Codenotify contains the Codenotify configuration, where the options after
+	// "BinPath" are defaults of the per-repository configuration file.
 	Codenotify struct {
-		BinPath string
+		Engine              string
+		BinPath             string
+		Filename            string
+		SubscriberThreshold int
+		IgnoredPaths        []string
+		NotifyOnDrafts      bool
+		CommentStyle        string
+		RulesFrom           string
 	}
 }
 
-// Load loads configuration from file.
+// DefaultGitHubApp is the name of the GitHub App configured in "[github_app]".
+const DefaultGitHubApp = "default"
+
+// GitHubApp contains the configuration of a GitHub App.
+type GitHubApp struct {
+	// Name is "default" for "[github_app]", or "<name>" for "[github_app.<name>]".
+	Name  string `ini:"-"`
+	AppID int64  `ini:"APP_ID"`
+	// APIURL and UploadURL are the base URLs of the API of GitHub Enterprise
+	// Server, or empty for GitHub.com.
+	APIURL        string `ini:"API_URL"`
+	UploadURL     string `ini:"UPLOAD_URL"`
+	ClientID      string `ini:"CLIENT_ID"`
+	ClientSecret  string
+	PrivateKey    string
+	WebhookSecret string
+	// WebhookPath is the path that receives webhook events of the GitHub App in
+	// addition to "/-/webhook".
+	WebhookPath string
+	Reporter    string
+	// RepoDefaults are the defaults of the per-repository configuration file,
+	// from "[codenotify]" overridden by "[codenotify.<name>]".
+	RepoDefaults repoconf.Config `ini:"-"`
+}
+
+// section returns the name of the configuration section of the GitHub App.
+func (app *GitHubApp) section() string {
+	if app.Name == DefaultGitHubApp {
+		return "github_app"
+	}
+	return "github_app." + app.Name
+}
+
+// Load loads configuration from file, where any key can be overridden by the
+// environment variable "CODENOTIFY_<SECTION>_<KEY>" and secrets can be read
+// from files, see applyOverrides for details.
 func Load() (*Config, error) {
+	return load("custom/conf/app.ini")
+}
+
+// load loads configuration from the default "app.ini" overridden by the custom
+// source, which is either a file path or []byte.
+func load(custom any) (*Config, error) {
 	data, err := conf.Files.ReadFile("app.ini")
 	if err != nil {
 		return nil, errors.Wrap(err, `read default "app.ini"`)
@@ -54,22 +172,178 @@ func Load() (*Config, error) {
 			IgnoreInlineComment: true,
 		},
 		data,
-		"custom/conf/app.ini",
+		custom,
 	)
 	if err != nil {
 		return nil, errors.Wrap(err, `load sources`)
 	}
 	file.NameMapper = ini.SnackCase
 
+	if err = applyOverrides(file); err != nil {
+		return nil, errors.Wrap(err, "apply overrides")
+	}
+
 	var config Config
 	if err = file.Section("server").MapTo(&config.Server); err != nil {
 		return nil, errors.Wrap(err, `mapping "[server]" section`)
-	} else if err = file.Section("github_app").MapTo(&config.GitHubApp); err != nil {
-		return nil, errors.Wrap(err, `mapping "[github_app]" section`)
+	} else if err = file.Section("s3").MapTo(&config.S3); err != nil {
+		return nil, errors.Wrap(err, `mapping "[s3]" section`)
+	} else if err = file.Section("database").MapTo(&config.Database); err != nil {
+		return nil, errors.Wrap(err, `mapping "[database]" section`)
+	} else if err = file.Section("admin").MapTo(&config.Admin); err != nil {
+		return nil, errors.Wrap(err, `mapping "[admin]" section`)
+	} else if err = file.Section("queue").MapTo(&config.Queue); err != nil {
+		return nil, errors.Wrap(err, `mapping "[queue]" section`)
+	} else if err = file.Section("retention").MapTo(&config.Retention); err != nil {
+		return nil, errors.Wrap(err, `mapping "[retention]" section`)
 	} else if err = file.Section("codenotify").MapTo(&config.Codenotify); err != nil {
 		return nil, errors.Wrap(err, `mapping "[codenotify]" section`)
 	}
 
 	config.Server.ExternalURL = strings.TrimSuffix(config.Server.ExternalURL, "/")
+
+	switch config.Server.LogsStorage {
+	case LogsStorageLocal:
+	case LogsStorageS3:
+		if config.S3.Endpoint == "" || config.S3.Bucket == "" {
+			return nil, errors.New(`"[s3] ENDPOINT" and "[s3] BUCKET" are required when "[server] LOGS_STORAGE" is "s3"`)
+		}
+	default:
+		return nil, errors.Errorf(`"[server] LOGS_STORAGE" must be either %q or %q but got %q`, LogsStorageLocal, LogsStorageS3, config.Server.LogsStorage)
+	}
+
+	switch config.Database.Type {
+	case DatabaseSQLite:
+	case DatabasePostgres:
+		if config.Database.DSN == "" {
+			return nil, errors.New(`"[database] DSN" is required when "[database] TYPE" is "postgres"`)
+		}
+	default:
+		return nil, errors.Errorf(`"[database] TYPE" must be either %q or %q but got %q`, DatabaseSQLite, DatabasePostgres, config.Database.Type)
+	}
+
+	switch config.Codenotify.Engine {
+	case EngineBuiltin, EngineBinary:
+	default:
+		return nil, errors.Errorf(`"[codenotify] ENGINE" must be either %q or %q but got %q`, EngineBuiltin, EngineBinary, config.Codenotify.Engine)
+	}
+
+	// NOTE: Child sections inherit keys of their parent sections, thus options
+	// that are not set in "[github_app.<name>]" and "[codenotify.<name>]" fall
+	// back to the ones in "[github_app]" and "[codenotify]" respectively.
+	sections := append([]*ini.Section{file.Section("github_app")}, file.Section("github_app").ChildSections()...)
+	for _, section := range sections {
+		app := &GitHubApp{Name: DefaultGitHubApp}
+		if section.Name() != "github_app" {
+			app.Name = strings.TrimPrefix(section.Name(), "github_app.")
+			if app.Name == DefaultGitHubApp {
+				return nil, errors.Errorf(`"[%s]" is reserved for "[github_app]"`, section.Name())
+			}
+		}
+		if err = section.MapTo(app); err != nil {
+			return nil, errors.Wrapf(err, `mapping "[%s]" section`, section.Name())
+		}
+		if app.Name != DefaultGitHubApp {
+			// NOTE: Credentials belong to each GitHub App, thus must never be
+			// inherited from "[github_app]".
+			app.ClientID = ownValue(section, "CLIENT_ID")
+			app.ClientSecret = ownValue(section, "CLIENT_SECRET")
+			app.PrivateKey = ownValue(section, "PRIVATE_KEY")
+			app.WebhookSecret = ownValue(section, "WEBHOOK_SECRET")
+		}
+
+		codenotifySection := "codenotify"
+		codenotify := config.Codenotify
+		if app.Name != DefaultGitHubApp {
+			codenotifySection = "codenotify." + app.Name
+			if section, err := file.GetSection(codenotifySection); err == nil {
+				if err = section.MapTo(&codenotify); err != nil {
+					return nil, errors.Wrapf(err, `mapping "[%s]" section`, section.Name())
+				}
+			}
+		}
+		app.RepoDefaults = repoconf.Config{
+			Filename:            codenotify.Filename,
+			SubscriberThreshold: codenotify.SubscriberThreshold,
+			IgnoredPaths:        codenotify.IgnoredPaths,
+			NotifyOnDrafts:      codenotify.NotifyOnDrafts,
+			CommentStyle:        codenotify.CommentStyle,
+			RulesFrom:           codenotify.RulesFrom,
+		}
+
+		if err = validateGitHubApp(app, config.GitHubApps); err != nil {
+			return nil, err
+		} else if err = app.RepoDefaults.Validate(); err != nil {
+			return nil, errors.Wrapf(err, `validate defaults of "[%s]" section`, codenotifySection)
+		}
+		if config.Codenotify.Engine == EngineBinary && app.RepoDefaults.RulesFrom != repoconf.RulesFromHead {
+			return nil, errors.Errorf(`"[%s] RULES_FROM" must be %q for the %q engine but got %q`, codenotifySection, repoconf.RulesFromHead, EngineBinary, app.RepoDefaults.RulesFrom)
+		}
+		config.GitHubApps = append(config.GitHubApps, app)
+	}
+	// NOTE: Webhook events delivered to "/-/webhook" fall back to the default app
+	// when they cannot be told apart, which must not skip checking signatures.
+	if len(config.GitHubApps) > 1 && config.GitHubApps[0].WebhookSecret == "" {
+		return nil, errors.New(`"[github_app] WEBHOOK_SECRET" is required when additional GitHub Apps are configured`)
+	}
+
+	if config.Retention.Interval <= 0 {
+		return nil, errors.Errorf(`"[retention] INTERVAL" must be positive but got %s`, config.Retention.Interval)
+	}
+
+	if config.Queue.Concurrency < 1 {
+		return nil, errors.Errorf(`"[queue] CONCURRENCY" must be at least 1 but got %d`, config.Queue.Concurrency)
+	}
 	return &config, nil
 }
+
+// validateGitHubApp validates the configuration of the GitHub App against the
+// apps that have been loaded, and fills in derived values.
+func validateGitHubApp(app *GitHubApp, apps []*GitHubApp) error {
+	section := app.section()
+	if app.APIURL != "" {
+		apiURL, err := url.Parse(app.APIURL)
+		if err != nil || (apiURL.Scheme != "http" && apiURL.Scheme != "https") || apiURL.Host == "" {
+			return errors.Errorf(`"[%s] API_URL" must be an absolute HTTP(S) URL but got %q`, section, app.APIURL)
+		}
+		if app.UploadURL == "" {
+			app.UploadURL = apiURL.Scheme + "://" + apiURL.Host + "/api/uploads/"
+		}
+	} else if app.UploadURL != "" {
+		return errors.Errorf(`"[%s] UPLOAD_URL" requires "[%s] API_URL" to be set`, section, section)
+	}
+
+	switch app.Reporter {
+	case ReporterChecks, ReporterStatuses:
+	default:
+		return errors.Errorf(`"[%s] REPORTER" must be either %q or %q but got %q`, section, ReporterChecks, ReporterStatuses, app.Reporter)
+	}
+
+	if app.WebhookPath != "" && !strings.HasPrefix(app.WebhookPath, "/") {
+		return errors.Errorf(`"[%s] WEBHOOK_PATH" must start with "/" but got %q`, section, app.WebhookPath)
+	} else if app.WebhookPath == "/-/webhook" {
+		return errors.Errorf(`"[%s] WEBHOOK_PATH" must not be "/-/webhook", which receives webhook events of all GitHub Apps`, section)
+	}
+
+	if app.Name == DefaultGitHubApp {
+		return nil
+	}
+
+	// Additional apps are told apart from each other by their App IDs and
+	// webhook paths.
+	if app.AppID <= 0 {
+		return errors.Errorf(`"[%s] APP_ID" is required`, section)
+	} else if app.PrivateKey == "" {
+		return errors.Errorf(`"[%s] PRIVATE_KEY" is required`, section)
+	} else if app.WebhookSecret == "" {
+		return errors.Errorf(`"[%s] WEBHOOK_SECRET" is required`, section)
+	}
+	for _, other := range apps {
+		if other.AppID == app.AppID {
+			return errors.Errorf(`"[%s] APP_ID" %d is already used by "[%s]"`, section, app.AppID, other.section())
+		} else if app.WebhookPath != "" && other.WebhookPath == app.WebhookPath {
+			return errors.Errorf(`"[%s] WEBHOOK_PATH" %q is already used by "[%s]"`, section, app.WebhookPath, other.section())
+		}
+	}
+	return nil
+}
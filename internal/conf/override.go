@@ -0,0 +1,123 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package conf
+
+import (
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/go-ini/ini"
+	"github.com/pkg/errors"
+)
+
+// secretKeys are the keys of each section that can also be read from files with
+// the "_PATH" suffix, e.g. "[github_app] PRIVATE_KEY_PATH". Child sections, e.g.
+// "[github_app.<name>]", have the same keys as their parents.
+var secretKeys = map[string][]string{
+	"s3":         {"SECRET_ACCESS_KEY"},
+	"database":   {"DSN"},
+	"admin":      {"TOKEN"},
+	"github_app": {"CLIENT_SECRET", "PRIVATE_KEY", "WEBHOOK_SECRET"},
+}
+
+// envName returns the name of the environment variable that overrides the key
+// of the section, e.g. "CODENOTIFY_GITHUB_APP_PRIVATE_KEY" for "[github_app]
+// PRIVATE_KEY" and "CODENOTIFY_GITHUB_APP_INTERNAL_PRIVATE_KEY" for
+// "[github_app.internal] PRIVATE_KEY".
+func envName(section, key string) string {
+	section = strings.NewReplacer(".", "_", "-", "_").Replace(section)
+	return "CODENOTIFY_" + strings.ToUpper(section) + "_" + key
+}
+
+// ownValue returns the value of the key that is set in the section itself,
+// which is empty when the key is only inherited from the parent section.
+func ownValue(section *ini.Section, key string) string {
+	if !slices.Contains(section.KeyStrings(), key) {
+		return ""
+	}
+	return section.Key(key).String()
+}
+
+// applyOverrides applies environment variables to all known keys of existing
+// sections, and then reads secrets from files. Values are taken in the
+// following order of precedence:
+//
+//  1. The environment variable "CODENOTIFY_<SECTION>_<KEY>" or
+//     "CODENOTIFY_<SECTION>_<KEY>_PATH".
+//  2. The key "<KEY>" or "<KEY>_PATH" in "custom/conf/app.ini".
+//  3. The key "<KEY>" in the default "app.ini".
+//
+// Setting both "<KEY>" and "<KEY>_PATH" at the same level is an error.
+func applyOverrides(file *ini.File) error {
+	for _, section := range file.Sections() {
+		if section.Name() == ini.DefaultSection {
+			continue
+		}
+
+		parent, _, _ := strings.Cut(section.Name(), ".")
+		secrets := secretKeys[parent]
+		isSecret := func(key string) bool {
+			return slices.Contains(secrets, key) || slices.Contains(secrets, strings.TrimSuffix(key, "_PATH"))
+		}
+
+		keys := section.KeyStrings()
+		for _, key := range section.ParentKeys() {
+			keys = append(keys, key.Name())
+		}
+		seen := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			if seen[key] || isSecret(key) {
+				continue
+			}
+			seen[key] = true
+
+			if value, ok := os.LookupEnv(envName(section.Name(), key)); ok {
+				// NOTE: Always set the key on the section itself, otherwise the key
+				// inherited from the parent section is changed.
+				_, _ = section.NewKey(key, value)
+			}
+		}
+
+		for _, key := range secrets {
+			if err := resolveSecret(section, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolveSecret applies environment variables to the secret key of the section,
+// and then reads the secret from the file of the "_PATH" key if set.
+func resolveSecret(section *ini.Section, key string) error {
+	pathKey := key + "_PATH"
+	value, valueOK := os.LookupEnv(envName(section.Name(), key))
+	path, pathOK := os.LookupEnv(envName(section.Name(), pathKey))
+	switch {
+	case valueOK && pathOK:
+		return errors.Errorf(`environment variables %q and %q must not be both set`, envName(section.Name(), key), envName(section.Name(), pathKey))
+	case valueOK:
+		section.DeleteKey(pathKey)
+		_, _ = section.NewKey(key, value)
+	case pathOK:
+		section.DeleteKey(key)
+		_, _ = section.NewKey(pathKey, path)
+	}
+
+	path = ownValue(section, pathKey)
+	if path == "" {
+		return nil
+	} else if ownValue(section, key) != "" {
+		return errors.Errorf(`"[%s] %s" and "[%s] %s" must not be both set`, section.Name(), key, section.Name(), pathKey)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, `read file of "[%s] %s"`, section.Name(), pathKey)
+	}
+	_, _ = section.NewKey(key, strings.TrimSpace(string(data)))
+	return nil
+}
@@ -0,0 +1,360 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package queue
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	bucketPending    = []byte("pending")
+	bucketRunning    = []byte("running")
+	bucketDeliveries = []byte("deliveries")
+)
+
+// ErrDuplicateDelivery is returned when a delivery has already been enqueued
+// and not yet expired.
+var ErrDuplicateDelivery = errors.New("duplicate delivery")
+
+// Job is a webhook event that has been accepted and waits to be processed.
+type Job struct {
+	// ID is the ULID of the job, which also determines its position in the
+	// queue.
+	ID string `json:"id"`
+	// App is the name of the GitHub App that the event is delivered for, where
+	// empty means the default app.
+	App string `json:"app,omitempty"`
+	// DeliveryID is the value of the "X-GitHub-Delivery" header.
+	DeliveryID string `json:"delivery_id"`
+	// Event is the value of the "X-GitHub-Event" header.
+	Event string `json:"event"`
+	// InstallationID is the ID of the GitHub App installation that the event
+	// belongs to.
+	InstallationID int64 `json:"installation_id"`
+	// Payload is the raw JSON payload of the event.
+	Payload json.RawMessage `json:"payload"`
+	// Attempts is the number of times the job has been claimed.
+	Attempts int `json:"attempts"`
+	// CreatedAt is the time when the job was enqueued.
+	CreatedAt time.Time `json:"created_at"`
+	// NotBefore is the time before which the job is not claimed, e.g. until the
+	// rate limit of the installation resets.
+	NotBefore time.Time `json:"not_before,omitzero"`
+}
+
+// Queue is a durable FIFO queue of jobs backed by an embedded on-disk store.
+// Jobs that are claimed but never completed (e.g. the process was restarted)
+// are put back to the queue when the queue is opened again.
+type Queue struct {
+	db          *bbolt.DB
+	notify      chan struct{}
+	deliveryTTL time.Duration
+
+	// lastInstallationID is the installation ID of the last claimed job, only
+	// accessed within write transactions.
+	lastInstallationID int64
+}
+
+// Open opens the queue stored at the given path, creating it if it does not
+// exist yet. All jobs left in running state are resumed as pending. Delivery IDs
+// of enqueued jobs are remembered for the given TTL to reject duplicate
+// deliveries.
+func Open(path string, deliveryTTL time.Duration) (*Queue, error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, errors.Wrap(err, "create directory")
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "open database")
+	}
+
+	q := &Queue{
+		db:          db,
+		notify:      make(chan struct{}, 1),
+		deliveryTTL: deliveryTTL,
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{bucketPending, bucketRunning, bucketDeliveries} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return errors.Wrapf(err, "create bucket %q", name)
+			}
+		}
+		return q.resume(tx)
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// resume moves all running jobs back to pending.
+func (q *Queue) resume(tx *bbolt.Tx) error {
+	pending := tx.Bucket(bucketPending)
+	running := tx.Bucket(bucketRunning)
+
+	var keys [][]byte
+	err := running.ForEach(func(k, v []byte) error {
+		keys = append(keys, k)
+		return pending.Put(k, v)
+	})
+	if err != nil {
+		return errors.Wrap(err, "copy running jobs")
+	}
+	for _, k := range keys {
+		if err = running.Delete(k); err != nil {
+			return errors.Wrap(err, "delete running job")
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying store.
+func (q *Queue) Close() error {
+	return q.db.Close()
+}
+
+// Notify returns a channel that receives a value whenever a new job is
+// enqueued.
+func (q *Queue) Notify() <-chan struct{} {
+	return q.notify
+}
+
+// Enqueue appends a new job for the given GitHub App, delivery, event,
+// installation and payload to the queue. It returns ErrDuplicateDelivery if the
+// same delivery ID has been enqueued within the TTL. An empty delivery ID is
+// never considered as duplicate.
+func (q *Queue) Enqueue(app, deliveryID, event string, installationID int64, payload []byte) (*Job, error) {
+	// NOTE: Use monotonic ULIDs so that jobs enqueued within the same
+	// millisecond are still claimed in order.
+	now := time.Now()
+	job := &Job{
+		ID:             ulid.Make().String(),
+		App:            app,
+		DeliveryID:     deliveryID,
+		Event:          event,
+		InstallationID: installationID,
+		Payload:        payload,
+		CreatedAt:      now,
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return nil, errors.Wrap(err, "encode job")
+	}
+
+	err = q.db.Update(func(tx *bbolt.Tx) error {
+		if deliveryID != "" {
+			deliveries := tx.Bucket(bucketDeliveries)
+			if v := deliveries.Get([]byte(deliveryID)); v != nil && now.Before(decodeTime(v)) {
+				return ErrDuplicateDelivery
+			}
+			if err := deliveries.Put([]byte(deliveryID), encodeTime(now.Add(q.deliveryTTL))); err != nil {
+				return errors.Wrap(err, "put delivery")
+			}
+		}
+		return tx.Bucket(bucketPending).Put([]byte(job.ID), data)
+	})
+	if err == ErrDuplicateDelivery {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.Wrap(err, "put job")
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Claim moves a pending job to running state and returns it. Installations
+// are served in round-robin order, and within the same installation the oldest
+// job comes first. Jobs of installations for which the allow function returns
+// false and jobs that are delayed are skipped. It returns nil if there is no
+// eligible pending job.
+func (q *Queue) Claim(allow func(installationID int64) bool) (*Job, error) {
+	now := time.Now()
+	var job *Job
+	var decodeErr error
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		pending := tx.Bucket(bucketPending)
+
+		// Find the oldest job of each eligible installation. An installation whose
+		// oldest job is delayed is not eligible, so that its jobs are still
+		// processed in order.
+		oldest := make(map[int64][]byte)
+		seen := make(map[int64]bool)
+		err := pending.ForEach(func(k, v []byte) error {
+			var j Job
+			if err := json.Unmarshal(v, &j); err != nil {
+				// Drop the malformed job so it doesn't block the rest of the queue.
+				decodeErr = errors.Wrapf(err, "decode job %q", k)
+				oldest = map[int64][]byte{}
+				return errStopIteration{key: k}
+			}
+			if seen[j.InstallationID] {
+				return nil
+			}
+			seen[j.InstallationID] = true
+			if !now.Before(j.NotBefore) && allow(j.InstallationID) {
+				oldest[j.InstallationID] = k
+			}
+			return nil
+		})
+		if stop, ok := err.(errStopIteration); ok {
+			return pending.Delete(stop.key)
+		} else if err != nil {
+			return errors.Wrap(err, "iterate pending jobs")
+		} else if len(oldest) == 0 {
+			return nil
+		}
+
+		installationIDs := make([]int64, 0, len(oldest))
+		for id := range oldest {
+			installationIDs = append(installationIDs, id)
+		}
+		sort.Slice(installationIDs, func(i, j int) bool { return installationIDs[i] < installationIDs[j] })
+
+		// Pick the next installation after the last served one, wrapping around
+		// to the first.
+		next := installationIDs[0]
+		for _, id := range installationIDs {
+			if id > q.lastInstallationID {
+				next = id
+				break
+			}
+		}
+
+		k := oldest[next]
+		job = new(Job)
+		if err = json.Unmarshal(pending.Get(k), job); err != nil {
+			return errors.Wrapf(err, "decode job %q", k)
+		}
+		job.Attempts++
+
+		data, err := json.Marshal(job)
+		if err != nil {
+			return errors.Wrap(err, "encode job")
+		}
+		if err = tx.Bucket(bucketRunning).Put(k, data); err != nil {
+			return errors.Wrap(err, "put running job")
+		}
+		q.lastInstallationID = next
+		return pending.Delete(k)
+	})
+	if err != nil {
+		return nil, err
+	} else if decodeErr != nil {
+		return nil, decodeErr
+	}
+	return job, nil
+}
+
+type errStopIteration struct {
+	key []byte
+}
+
+func (errStopIteration) Error() string {
+	return "stop iteration"
+}
+
+// Complete removes the running job with given ID from the queue.
+func (q *Queue) Complete(id string) error {
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketRunning).Delete([]byte(id))
+	})
+}
+
+// Requeue moves the running job with given ID back to pending, which is not
+// claimed again until the given time. The attempt is not counted towards the
+// number of attempts of the job because it never got the chance to finish.
+func (q *Queue) Requeue(id string, notBefore time.Time) error {
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		running := tx.Bucket(bucketRunning)
+		v := running.Get([]byte(id))
+		if v == nil {
+			return errors.Errorf("job %q is not running", id)
+		}
+
+		var job Job
+		if err := json.Unmarshal(v, &job); err != nil {
+			return errors.Wrapf(err, "decode job %q", id)
+		}
+		job.Attempts--
+		job.NotBefore = notBefore
+
+		data, err := json.Marshal(job)
+		if err != nil {
+			return errors.Wrap(err, "encode job")
+		}
+		if err = tx.Bucket(bucketPending).Put([]byte(id), data); err != nil {
+			return errors.Wrap(err, "put pending job")
+		}
+		return running.Delete([]byte(id))
+	})
+}
+
+// Depth returns the number of pending and running jobs in the queue.
+func (q *Queue) Depth() (pending, running int, err error) {
+	err = q.db.View(func(tx *bbolt.Tx) error {
+		pending = tx.Bucket(bucketPending).Stats().KeyN
+		running = tx.Bucket(bucketRunning).Stats().KeyN
+		return nil
+	})
+	return pending, running, err
+}
+
+// PurgeExpiredDeliveries removes all delivery IDs that have expired.
+func (q *Queue) PurgeExpiredDeliveries() (int, error) {
+	now := time.Now()
+	var purged int
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		deliveries := tx.Bucket(bucketDeliveries)
+
+		var expired [][]byte
+		err := deliveries.ForEach(func(k, v []byte) error {
+			if !now.Before(decodeTime(v)) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "iterate deliveries")
+		}
+
+		for _, k := range expired {
+			if err = deliveries.Delete(k); err != nil {
+				return errors.Wrapf(err, "delete delivery %q", k)
+			}
+		}
+		purged = len(expired)
+		return nil
+	})
+	return purged, err
+}
+
+func encodeTime(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+func decodeTime(b []byte) time.Time {
+	if len(b) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+}
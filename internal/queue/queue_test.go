@@ -0,0 +1,167 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package queue
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	q, err := Open(path, time.Hour)
+	require.NoError(t, err)
+
+	job1, err := q.Enqueue("default", "", "pull_request", 1, []byte(`{"number":1}`))
+	require.NoError(t, err)
+	job2, err := q.Enqueue("default", "", "pull_request", 1, []byte(`{"number":2}`))
+	require.NoError(t, err)
+
+	pending, running, err := q.Depth()
+	require.NoError(t, err)
+	assert.Equal(t, 2, pending)
+	assert.Equal(t, 0, running)
+
+	got, err := q.Claim(allowAll)
+	require.NoError(t, err)
+	assert.Equal(t, job1.ID, got.ID)
+	assert.Equal(t, 1, got.Attempts)
+
+	pending, running, err = q.Depth()
+	require.NoError(t, err)
+	assert.Equal(t, 1, pending)
+	assert.Equal(t, 1, running)
+	assert.JSONEq(t, `{"number":1}`, string(got.Payload))
+	require.NoError(t, q.Complete(got.ID))
+
+	got, err = q.Claim(allowAll)
+	require.NoError(t, err)
+	assert.Equal(t, job2.ID, got.ID)
+
+	// Simulate a restart before the second job is completed.
+	require.NoError(t, q.Close())
+	q, err = Open(path, time.Hour)
+	require.NoError(t, err)
+	defer func() { _ = q.Close() }()
+
+	got, err = q.Claim(allowAll)
+	require.NoError(t, err)
+	assert.Equal(t, job2.ID, got.ID)
+	assert.Equal(t, 2, got.Attempts)
+	require.NoError(t, q.Complete(got.ID))
+
+	got, err = q.Claim(allowAll)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func TestQueue_ClaimRoundRobin(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.db"), time.Hour)
+	require.NoError(t, err)
+	defer func() { _ = q.Close() }()
+
+	// Installation 1 has a burst of jobs, installation 2 and 3 only have one each.
+	for _, installationID := range []int64{1, 1, 1, 2, 3} {
+		_, err = q.Enqueue("default", "", "pull_request", installationID, []byte(`{}`))
+		require.NoError(t, err)
+	}
+
+	var got []int64
+	for {
+		job, err := q.Claim(allowAll)
+		require.NoError(t, err)
+		if job == nil {
+			break
+		}
+		got = append(got, job.InstallationID)
+	}
+	assert.Equal(t, []int64{1, 2, 3, 1, 1}, got)
+}
+
+func TestQueue_ClaimSkipsDisallowed(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.db"), time.Hour)
+	require.NoError(t, err)
+	defer func() { _ = q.Close() }()
+
+	_, err = q.Enqueue("default", "", "pull_request", 1, []byte(`{}`))
+	require.NoError(t, err)
+
+	job, err := q.Claim(func(installationID int64) bool { return installationID != 1 })
+	require.NoError(t, err)
+	assert.Nil(t, job)
+
+	job, err = q.Claim(allowAll)
+	require.NoError(t, err)
+	require.NotNil(t, job)
+	assert.Equal(t, int64(1), job.InstallationID)
+}
+
+func TestQueue_DuplicateDelivery(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.db"), time.Hour)
+	require.NoError(t, err)
+	defer func() { _ = q.Close() }()
+
+	_, err = q.Enqueue("default", "72d3162e", "pull_request", 1, []byte(`{}`))
+	require.NoError(t, err)
+	_, err = q.Enqueue("default", "72d3162e", "pull_request", 1, []byte(`{}`))
+	assert.Equal(t, ErrDuplicateDelivery, err)
+
+	// An expired delivery is no longer considered as duplicate.
+	q.deliveryTTL = -time.Second
+	_, err = q.Enqueue("default", "5b0a4d1c", "pull_request", 1, []byte(`{}`))
+	require.NoError(t, err)
+	purged, err := q.PurgeExpiredDeliveries()
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	_, err = q.Enqueue("default", "5b0a4d1c", "pull_request", 1, []byte(`{}`))
+	require.NoError(t, err)
+}
+
+func allowAll(int64) bool { return true }
+
+func TestQueue_Requeue(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.db"), time.Hour)
+	require.NoError(t, err)
+	defer func() { _ = q.Close() }()
+
+	job1, err := q.Enqueue("default", "", "pull_request", 1, []byte(`{}`))
+	require.NoError(t, err)
+	job2, err := q.Enqueue("default", "", "pull_request", 1, []byte(`{}`))
+	require.NoError(t, err)
+	job3, err := q.Enqueue("default", "", "pull_request", 2, []byte(`{}`))
+	require.NoError(t, err)
+
+	got, err := q.Claim(allowAll)
+	require.NoError(t, err)
+	require.Equal(t, job1.ID, got.ID)
+	notBefore := time.Now().Add(100 * time.Millisecond)
+	require.NoError(t, q.Requeue(got.ID, notBefore))
+	assert.Error(t, q.Requeue(got.ID, notBefore), "job is no longer running")
+
+	// Jobs of the installation are not claimed while its oldest job is delayed.
+	got, err = q.Claim(allowAll)
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, job3.ID, got.ID)
+	got, err = q.Claim(allowAll)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	// The delayed job is claimed again once due, without counting the attempt.
+	time.Sleep(time.Until(notBefore))
+	got, err = q.Claim(allowAll)
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, job1.ID, got.ID)
+	assert.Equal(t, 1, got.Attempts)
+	got, err = q.Claim(allowAll)
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, job2.ID, got.ID)
+}
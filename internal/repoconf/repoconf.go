@@ -0,0 +1,141 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package repoconf implements the per-repository configuration file, which
+// lets repositories override server-side defaults of running Codenotify.
+package repoconf
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/codenotify/codenotify.run/internal/codenotify"
+)
+
+// Path is the path of the configuration file in a repository.
+const Path = ".github/codenotify.yml"
+
+// Schema is the JSON Schema of the configuration file.
+//
+//go:embed schema.json
+var Schema []byte
+
+// The available values of the comment style.
+const (
+	// CommentStyleTable renders the report as a table, same as the upstream
+	// Codenotify.
+	CommentStyleTable = "table"
+	// CommentStyleList renders the report as a bulleted list.
+	CommentStyleList = "list"
+	// CommentStyleNone does not comment on pull requests, the report is only
+	// available in the check run.
+	CommentStyleNone = "none"
+)
+
+// The available values of where rules are read from.
+const (
+	// RulesFromHead reads rules from the head of pull requests.
+	RulesFromHead = "head"
+	// RulesFromBase reads rules from the base of pull requests, thus changes to
+	// rules only take effect after being merged.
+	RulesFromBase = "base"
+	// RulesFromUnion reads rules from both the base and the head of pull
+	// requests.
+	RulesFromUnion = "union"
+)
+
+// Config contains the per-repository configuration.
+type Config struct {
+	// Filename is the name of files that contain rules.
+	Filename string `yaml:"filename"`
+	// SubscriberThreshold is the maximum number of subscribers to be notified, 0
+	// means no limit.
+	SubscriberThreshold int `yaml:"subscriber_threshold"`
+	// IgnoredPaths is the list of patterns of files that never notify anyone.
+	IgnoredPaths []string `yaml:"ignored_paths"`
+	// NotifyOnDrafts indicates whether to run Codenotify on draft pull requests.
+	NotifyOnDrafts bool `yaml:"notify_on_drafts"`
+	// CommentStyle is the style of the report comment.
+	CommentStyle string `yaml:"comment_style"`
+	// RulesFrom is where rules are read from, it prevents authors of pull
+	// requests from unsubscribing people by changing rules in the same pull
+	// request when not reading rules only from the head.
+	RulesFrom string `yaml:"rules_from"`
+}
+
+// ValidationError is the error of an invalid configuration file, which is
+// caused by the repository rather than the server.
+type ValidationError struct {
+	Problems []string
+}
+
+func (err *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", Path, strings.Join(err.Problems, "; "))
+}
+
+// Parse parses the configuration file with fields not present in the file
+// taking values from the defaults. It returns *ValidationError if the file is
+// malformed or has invalid values.
+func Parse(data []byte, defaults Config) (*Config, error) {
+	config := defaults
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(&config)
+	if err != nil && err != io.EOF {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			return nil, &ValidationError{Problems: typeErr.Errors}
+		}
+		return nil, &ValidationError{Problems: []string{err.Error()}}
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Validate returns *ValidationError if the configuration has invalid values.
+func (c *Config) Validate() error {
+	var problems []string
+	if c.Filename == "" {
+		problems = append(problems, `"filename" must not be empty`)
+	} else if strings.ContainsAny(c.Filename, `/\`) {
+		problems = append(problems, fmt.Sprintf(`"filename" must not contain path separators but got %q`, c.Filename))
+	}
+
+	if c.SubscriberThreshold < 0 {
+		problems = append(problems, fmt.Sprintf(`"subscriber_threshold" must not be negative but got %d`, c.SubscriberThreshold))
+	}
+
+	for _, pattern := range c.IgnoredPaths {
+		if err := codenotify.ValidatePattern(pattern); err != nil {
+			problems = append(problems, fmt.Sprintf(`"ignored_paths" has invalid pattern %q: %v`, pattern, err))
+		}
+	}
+
+	switch c.CommentStyle {
+	case CommentStyleTable, CommentStyleList, CommentStyleNone:
+	default:
+		problems = append(problems, fmt.Sprintf(`"comment_style" must be one of %q, %q and %q but got %q`, CommentStyleTable, CommentStyleList, CommentStyleNone, c.CommentStyle))
+	}
+
+	switch c.RulesFrom {
+	case RulesFromHead, RulesFromBase, RulesFromUnion:
+	default:
+		problems = append(problems, fmt.Sprintf(`"rules_from" must be one of %q, %q and %q but got %q`, RulesFromHead, RulesFromBase, RulesFromUnion, c.RulesFrom))
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package repoconf
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	defaults := Config{
+		Filename:            "CODENOTIFY",
+		SubscriberThreshold: 10,
+		IgnoredPaths:        []string{"vendor/**"},
+		CommentStyle:        CommentStyleTable,
+		RulesFrom:           RulesFromHead,
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		got, err := Parse(nil, defaults)
+		require.NoError(t, err)
+		assert.Equal(t, &defaults, got)
+	})
+
+	t.Run("override", func(t *testing.T) {
+		got, err := Parse([]byte(`
+filename: OWNERS
+ignored_paths:
+  - "**/*_test.go"
+notify_on_drafts: true
+comment_style: list
+rules_from: union
+`), defaults)
+		require.NoError(t, err)
+		want := &Config{
+			Filename:            "OWNERS",
+			SubscriberThreshold: 10,
+			IgnoredPaths:        []string{"**/*_test.go"},
+			NotifyOnDrafts:      true,
+			CommentStyle:        CommentStyleList,
+			RulesFrom:           RulesFromUnion,
+		}
+		assert.Equal(t, want, got)
+	})
+
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{
+			name: "unknown field",
+			data: "filenames: OWNERS\n",
+			want: []string{"line 1: field filenames not found in type repoconf.Config"},
+		},
+		{
+			name: "wrong type",
+			data: "subscriber_threshold: many\n",
+			want: []string{"line 1: cannot unmarshal !!str `many` into int"},
+		},
+		{
+			name: "invalid values",
+			data: "filename: docs/OWNERS\nsubscriber_threshold: -1\nignored_paths: [/README.md]\ncomment_style: fancy\nrules_from: tail\n",
+			want: []string{
+				`"filename" must not contain path separators but got "docs/OWNERS"`,
+				`"subscriber_threshold" must not be negative but got -1`,
+				`"ignored_paths" has invalid pattern "/README.md": pattern must be relative to the root`,
+				`"comment_style" must be one of "table", "list" and "none" but got "fancy"`,
+				`"rules_from" must be one of "head", "base" and "union" but got "tail"`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse([]byte(test.data), defaults)
+			var validationErr *ValidationError
+			require.ErrorAs(t, err, &validationErr)
+			assert.Equal(t, test.want, validationErr.Problems)
+		})
+	}
+}
+
+func TestSchema(t *testing.T) {
+	var schema struct {
+		Properties map[string]any `json:"properties"`
+	}
+	require.NoError(t, json.Unmarshal(Schema, &schema))
+
+	// Every field of the configuration should be documented in the schema.
+	typ := reflect.TypeOf(Config{})
+	assert.Len(t, schema.Properties, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		assert.Contains(t, schema.Properties, typ.Field(i).Tag.Get("yaml"))
+	}
+}
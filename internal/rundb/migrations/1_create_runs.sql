@@ -0,0 +1,18 @@
+CREATE TABLE runs (
+    id              TEXT PRIMARY KEY,
+    repository      TEXT NOT NULL,
+    repository_id   BIGINT NOT NULL,
+    installation_id BIGINT NOT NULL,
+    pull_request    INTEGER NOT NULL,
+    base_sha        TEXT NOT NULL,
+    head_sha        TEXT NOT NULL,
+    trigger_event   TEXT NOT NULL,
+    state           TEXT NOT NULL,
+    started_at      TIMESTAMP NOT NULL,
+    duration_ms     BIGINT NOT NULL,
+    error           TEXT NOT NULL,
+    subscribers     TEXT NOT NULL
+);
+
+CREATE INDEX idx_runs_repository_pull_request ON runs (repository, pull_request);
+CREATE INDEX idx_runs_started_at ON runs (started_at);
@@ -0,0 +1,8 @@
+-- Sessions of the web UI, which are only stored in the database with
+-- PostgreSQL. The table is created here so that replicas do not race to create
+-- it.
+CREATE TABLE sessions (
+    key        TEXT PRIMARY KEY,
+    data       BYTEA NOT NULL,
+    expired_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
@@ -0,0 +1,463 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package rundb stores the history of Codenotify runs in a SQL database, which
+// is either SQLite or PostgreSQL.
+package rundb
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // Register the "pgx" driver
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite" // Register the "sqlite" driver
+)
+
+// The supported database types.
+const (
+	TypeSQLite   = "sqlite"
+	TypePostgres = "postgres"
+)
+
+// ErrNotExist is returned when the run does not exist.
+var ErrNotExist = errors.New("run does not exist")
+
+// Run is a run of Codenotify on a pull request.
+type Run struct {
+	// ID is the ULID of the run, which is also the ID of the run log.
+	ID             string
+	Repository     string
+	RepositoryID   int64
+	InstallationID int64
+	PullRequest    int
+	BaseSHA        string
+	HeadSHA        string
+	// Trigger is the event that triggered the run, e.g. "pull_request.opened".
+	Trigger   string
+	State     string
+	StartedAt time.Time
+	Duration  time.Duration
+	// Error is the error message of the run, it is empty when the run succeeded.
+	Error string
+	// Subscribers maps notified subscribers to files they are notified for.
+	Subscribers map[string][]string
+}
+
+// DB is the database of run history.
+type DB struct {
+	db  *sql.DB
+	typ string
+}
+
+// Open opens the database of the given type and applies pending migrations.
+// The source is the file path for SQLite, or the connection string for
+// PostgreSQL.
+func Open(ctx context.Context, typ, source string) (*DB, error) {
+	var db *sql.DB
+	var err error
+	switch typ {
+	case TypeSQLite:
+		err = os.MkdirAll(filepath.Dir(source), os.ModePerm)
+		if err != nil {
+			return nil, errors.Wrap(err, "create directory")
+		}
+		db, err = sql.Open("sqlite", "file:"+source+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+		if err == nil {
+			// SQLite allows only one writer at a time.
+			db.SetMaxOpenConns(1)
+		}
+	case TypePostgres:
+		db, err = sql.Open("pgx", source)
+	default:
+		return nil, errors.Errorf("unsupported database type %q", typ)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "open database")
+	}
+
+	d := &DB{db: db, typ: typ}
+	err = d.migrate(ctx)
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Wrap(err, "migrate")
+	}
+	return d, nil
+}
+
+// Close closes the database.
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// rebind rewrites "?" placeholders of the query to the ones of the database.
+func (d *DB) rebind(query string) string {
+	if d.typ != TypePostgres {
+		return query
+	}
+
+	var b strings.Builder
+	var n int
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+// migration is a schema change, which is applied exactly once in the order of
+// versions.
+type migration struct {
+	version int
+	sql     string
+}
+
+// migrations returns all migrations ordered by versions, which are the numeric
+// prefixes of file names, e.g. "1_create_runs.sql".
+func migrations() ([]migration, error) {
+	entries, err := migrationFS.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, entry := range entries {
+		prefix, _, _ := strings.Cut(entry.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, errors.Errorf("malformed migration file name %q", entry.Name())
+		}
+		data, err := migrationFS.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, sql: string(data)})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+// migrationLockID is the key of the PostgreSQL advisory lock that is held while
+// applying migrations.
+const migrationLockID = 0x636f64656e6f74 // "codenot"
+
+// migrate applies pending migrations, each in its own transaction along with
+// the record of its version.
+func (d *DB) migrate(ctx context.Context) error {
+	// NOTE: Advisory locks belong to the database session, thus everything is
+	// done with the same connection.
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get connection")
+	}
+	defer func() { _ = conn.Close() }()
+
+	// NOTE: Replicas that start together would otherwise apply the same
+	// migrations at the same time, where all but one of them fail.
+	if d.typ == TypePostgres {
+		_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID)
+		if err != nil {
+			return errors.Wrap(err, "acquire lock")
+		}
+		defer func() {
+			_, _ = conn.ExecContext(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+		}()
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return errors.Wrap(err, "create table")
+	}
+
+	// NOTE: The current version is only read after the lock is acquired, which
+	// includes migrations applied by others in the meantime.
+	var current int
+	err = conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return errors.Wrap(err, "get current version")
+	}
+
+	migrations, err := migrations()
+	if err != nil {
+		return errors.Wrap(err, "list migrations")
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return errors.Wrap(err, "begin transaction")
+		}
+		// NOTE: Not every driver supports multiple statements in a single call.
+		for _, stmt := range strings.Split(m.sql, ";") {
+			if strings.TrimSpace(stmt) == "" {
+				continue
+			}
+			_, err = tx.ExecContext(ctx, stmt)
+			if err != nil {
+				_ = tx.Rollback()
+				return errors.Wrapf(err, "apply migration %d", m.version)
+			}
+		}
+		_, err = tx.ExecContext(ctx, d.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), m.version)
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Wrapf(err, "record migration %d", m.version)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return errors.Wrapf(err, "commit migration %d", m.version)
+		}
+	}
+	return nil
+}
+
+const runColumns = `id, repository, repository_id, installation_id, pull_request, base_sha, head_sha, trigger_event, state, started_at, duration_ms, error, subscribers`
+
+// CreateRun records the run.
+func (d *DB) CreateRun(ctx context.Context, run *Run) error {
+	subscribers, err := json.Marshal(run.Subscribers)
+	if err != nil {
+		return errors.Wrap(err, "encode subscribers")
+	}
+
+	_, err = d.db.ExecContext(
+		ctx,
+		d.rebind(`INSERT INTO runs (`+runColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		run.ID,
+		run.Repository,
+		run.RepositoryID,
+		run.InstallationID,
+		run.PullRequest,
+		run.BaseSHA,
+		run.HeadSHA,
+		run.Trigger,
+		run.State,
+		run.StartedAt.UTC(),
+		run.Duration.Milliseconds(),
+		run.Error,
+		string(subscribers),
+	)
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanRun(s scanner) (*Run, error) {
+	var run Run
+	var durationMs int64
+	var subscribers string
+	err := s.Scan(
+		&run.ID,
+		&run.Repository,
+		&run.RepositoryID,
+		&run.InstallationID,
+		&run.PullRequest,
+		&run.BaseSHA,
+		&run.HeadSHA,
+		&run.Trigger,
+		&run.State,
+		&run.StartedAt,
+		&durationMs,
+		&run.Error,
+		&subscribers,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	run.StartedAt = run.StartedAt.UTC()
+	run.Duration = time.Duration(durationMs) * time.Millisecond
+	err = json.Unmarshal([]byte(subscribers), &run.Subscribers)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode subscribers")
+	}
+	return &run, nil
+}
+
+// GetRun returns the run with the given ID. It returns ErrNotExist when the run
+// does not exist.
+func (d *DB) GetRun(ctx context.Context, id string) (*Run, error) {
+	row := d.db.QueryRowContext(ctx, d.rebind(`SELECT `+runColumns+` FROM runs WHERE id = ?`), id)
+	run, err := scanRun(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotExist
+	}
+	return run, err
+}
+
+// ListRunsOptions contains the options to list runs, where zero values mean no
+// filtering.
+type ListRunsOptions struct {
+	Repository  string
+	PullRequest int
+	State       string
+	// Since and Until limit runs to the ones started within [Since, Until).
+	Since time.Time
+	Until time.Time
+	// Limit is the maximum number of runs to return.
+	Limit int
+}
+
+// ListRuns returns runs that match the options, from the newest to the oldest.
+func (d *DB) ListRuns(ctx context.Context, opts ListRunsOptions) ([]*Run, error) {
+	var conds []string
+	var args []any
+	if opts.Repository != "" {
+		conds = append(conds, "repository = ?")
+		args = append(args, opts.Repository)
+	}
+	if opts.PullRequest > 0 {
+		conds = append(conds, "pull_request = ?")
+		args = append(args, opts.PullRequest)
+	}
+	if opts.State != "" {
+		conds = append(conds, "state = ?")
+		args = append(args, opts.State)
+	}
+	if !opts.Since.IsZero() {
+		conds = append(conds, "started_at >= ?")
+		args = append(args, opts.Since.UTC())
+	}
+	if !opts.Until.IsZero() {
+		conds = append(conds, "started_at < ?")
+		args = append(args, opts.Until.UTC())
+	}
+
+	query := `SELECT ` + runColumns + ` FROM runs`
+	if len(conds) > 0 {
+		query += ` WHERE ` + strings.Join(conds, " AND ")
+	}
+	// Run IDs are ULIDs, which are ordered by time.
+	query += ` ORDER BY id DESC`
+	if opts.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, opts.Limit)
+	}
+
+	rows, err := d.db.QueryContext(ctx, d.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var runs []*Run
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan")
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// LastActivities returns the start time of the latest run of each installation.
+func (d *DB) LastActivities(ctx context.Context) (map[int64]time.Time, error) {
+	// NOTE: Run IDs are ULIDs, thus the maximum ID is the latest run.
+	rows, err := d.db.QueryContext(ctx, `SELECT installation_id, started_at FROM runs WHERE id IN (SELECT MAX(id) FROM runs GROUP BY installation_id)`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	activities := make(map[int64]time.Time)
+	for rows.Next() {
+		var installationID int64
+		var startedAt time.Time
+		err = rows.Scan(&installationID, &startedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan")
+		}
+		activities[installationID] = startedAt.UTC()
+	}
+	return activities, rows.Err()
+}
+
+// CountStates returns the number of runs of each state started since the given
+// time.
+func (d *DB) CountStates(ctx context.Context, since time.Time) (map[string]int, error) {
+	rows, err := d.db.QueryContext(ctx, d.rebind(`SELECT state, COUNT(*) FROM runs WHERE started_at >= ? GROUP BY state`), since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var state string
+		var count int
+		err = rows.Scan(&state, &count)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan")
+		}
+		counts[state] = count
+	}
+	return counts, rows.Err()
+}
+
+// RepositoryDuration is the duration statistics of runs of a repository.
+type RepositoryDuration struct {
+	Repository      string
+	Runs            int
+	AverageDuration time.Duration
+	MaxDuration     time.Duration
+}
+
+// SlowestRepositories returns at most the given number of repositories with the
+// longest average duration of runs started since the given time, from the
+// slowest to the fastest.
+func (d *DB) SlowestRepositories(ctx context.Context, since time.Time, limit int) ([]*RepositoryDuration, error) {
+	rows, err := d.db.QueryContext(
+		ctx,
+		d.rebind(`
+SELECT repository, COUNT(*), CAST(AVG(duration_ms) AS BIGINT), MAX(duration_ms)
+FROM runs
+WHERE started_at >= ?
+GROUP BY repository
+ORDER BY AVG(duration_ms) DESC, repository
+LIMIT ?`),
+		since.UTC(),
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var repos []*RepositoryDuration
+	for rows.Next() {
+		var repo RepositoryDuration
+		var avgMs, maxMs int64
+		err = rows.Scan(&repo.Repository, &repo.Runs, &avgMs, &maxMs)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan")
+		}
+		repo.AverageDuration = time.Duration(avgMs) * time.Millisecond
+		repo.MaxDuration = time.Duration(maxMs) * time.Millisecond
+		repos = append(repos, &repo)
+	}
+	return repos, rows.Err()
+}
@@ -0,0 +1,194 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package rundb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDB tests the behaviors that every database type should have.
+func testDB(t *testing.T, db *DB) {
+	ctx := context.Background()
+
+	_, err := db.GetRun(ctx, ulid.Make().String())
+	assert.Equal(t, ErrNotExist, err)
+
+	startedAt := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	run1 := &Run{
+		ID:             ulid.Make().String(),
+		Repository:     "codenotify/codenotify.run",
+		RepositoryID:   1,
+		InstallationID: 2,
+		PullRequest:    1234,
+		BaseSHA:        "1111111111111111111111111111111111111111",
+		HeadSHA:        "2222222222222222222222222222222222222222",
+		Trigger:        "pull_request.opened",
+		State:          "success",
+		StartedAt:      startedAt,
+		Duration:       1500 * time.Millisecond,
+		Subscribers: map[string][]string{
+			"@alice": {"README.md", "main.go"},
+			"@bob":   {"main.go"},
+		},
+	}
+	require.NoError(t, db.CreateRun(ctx, run1))
+	run2 := &Run{
+		ID:          ulid.Make().String(),
+		Repository:  "codenotify/codenotify.run",
+		PullRequest: 1235,
+		Trigger:     "check_run.rerequested",
+		State:       "error",
+		StartedAt:   startedAt.Add(time.Minute),
+		Error:       "clone pull request: exit status 128",
+	}
+	require.NoError(t, db.CreateRun(ctx, run2))
+	run3 := &Run{
+		ID:          ulid.Make().String(),
+		Repository:  "codenotify/other",
+		PullRequest: 1234,
+		State:       "success",
+		StartedAt:   startedAt.Add(2 * time.Minute),
+		Subscribers: map[string][]string{},
+	}
+	require.NoError(t, db.CreateRun(ctx, run3))
+
+	got, err := db.GetRun(ctx, run1.ID)
+	require.NoError(t, err)
+	assert.Equal(t, run1, got)
+
+	// Duplicated IDs are rejected.
+	assert.Error(t, db.CreateRun(ctx, run1))
+
+	runs, err := db.ListRuns(ctx, ListRunsOptions{})
+	require.NoError(t, err)
+	require.Len(t, runs, 3)
+	assert.Equal(t, run3.ID, runs[0].ID)
+	assert.Equal(t, run2.ID, runs[1].ID)
+	assert.Equal(t, run1.ID, runs[2].ID)
+
+	runs, err = db.ListRuns(ctx, ListRunsOptions{Repository: "codenotify/codenotify.run", PullRequest: 1234})
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, run1, runs[0])
+
+	runs, err = db.ListRuns(ctx, ListRunsOptions{Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, run3.ID, runs[0].ID)
+
+	runs, err = db.ListRuns(ctx, ListRunsOptions{State: "success"})
+	require.NoError(t, err)
+	require.Len(t, runs, 2)
+	assert.Equal(t, run3.ID, runs[0].ID)
+	assert.Equal(t, run1.ID, runs[1].ID)
+
+	runs, err = db.ListRuns(ctx, ListRunsOptions{Since: startedAt.Add(time.Minute), Until: startedAt.Add(2 * time.Minute)})
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, run2.ID, runs[0].ID)
+
+	// The time zone of filters does not matter.
+	runs, err = db.ListRuns(ctx, ListRunsOptions{Since: startedAt.Add(90 * time.Second).In(time.FixedZone("UTC+8", 8*60*60))})
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, run3.ID, runs[0].ID)
+
+	activities, err := db.LastActivities(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[int64]time.Time{0: run3.StartedAt, 2: run1.StartedAt}, activities)
+
+	counts, err := db.CountStates(ctx, startedAt)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"success": 2, "error": 1}, counts)
+	counts, err = db.CountStates(ctx, startedAt.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"success": 1, "error": 1}, counts)
+
+	repos, err := db.SlowestRepositories(ctx, startedAt, 10)
+	require.NoError(t, err)
+	require.Len(t, repos, 2)
+	assert.Equal(t, &RepositoryDuration{Repository: "codenotify/codenotify.run", Runs: 2, AverageDuration: 750 * time.Millisecond, MaxDuration: 1500 * time.Millisecond}, repos[0])
+	assert.Equal(t, &RepositoryDuration{Repository: "codenotify/other", Runs: 1}, repos[1])
+
+	repos, err = db.SlowestRepositories(ctx, startedAt, 1)
+	require.NoError(t, err)
+	require.Len(t, repos, 1)
+	assert.Equal(t, "codenotify/codenotify.run", repos[0].Repository)
+}
+
+func TestSQLite(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "data", "codenotify.db")
+	db, err := Open(ctx, TypeSQLite, path)
+	require.NoError(t, err)
+	testDB(t, db)
+	require.NoError(t, db.Close())
+
+	// Migrations are only applied once.
+	db, err = Open(ctx, TypeSQLite, path)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	runs, err := db.ListRuns(ctx, ListRunsOptions{})
+	require.NoError(t, err)
+	assert.Len(t, runs, 3)
+}
+
+// TestPostgres runs against the PostgreSQL database of "TEST_POSTGRES_DSN", and
+// is skipped when the variable is not set. The database must be empty.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+
+	ctx := context.Background()
+	t.Cleanup(func() {
+		db, err := Open(ctx, TypePostgres, dsn)
+		if err == nil {
+			_, _ = db.db.Exec(`DROP TABLE runs, sessions, schema_migrations`)
+			_ = db.Close()
+		}
+	})
+
+	// Replicas that start together apply migrations only once.
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db, err := Open(ctx, TypePostgres, dsn)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			errs[i] = db.Close()
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	db, err := Open(ctx, TypePostgres, dsn)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	testDB(t, db)
+}
+
+func TestRebind(t *testing.T) {
+	query := `SELECT * FROM runs WHERE repository = ? AND pull_request = ? LIMIT ?`
+	assert.Equal(t, query, (&DB{typ: TypeSQLite}).rebind(query))
+	assert.Equal(t, `SELECT * FROM runs WHERE repository = $1 AND pull_request = $2 LIMIT $3`, (&DB{typ: TypePostgres}).rebind(query))
+}
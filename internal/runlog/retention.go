@@ -0,0 +1,122 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package runlog
+
+import (
+	"context"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+)
+
+// RetentionPolicy is the policy of how long run logs are kept, where zero
+// values mean no limit.
+type RetentionPolicy struct {
+	// MaxAge is the maximum age of runs.
+	MaxAge time.Duration
+	// MaxTotalSize is the maximum total size of all runs in bytes, the oldest
+	// runs are deleted first when exceeded.
+	MaxTotalSize int64
+	// MaxRunsPerRepository is the maximum number of runs of a single repository,
+	// the oldest runs are deleted first when exceeded.
+	MaxRunsPerRepository int
+}
+
+// The reasons of deleting runs.
+const (
+	ReasonMaxAge               = "max_age"
+	ReasonMaxTotalSize         = "max_total_size"
+	ReasonMaxRunsPerRepository = "max_runs_per_repository"
+)
+
+// Reclaimed is the number of runs and bytes that are reclaimed.
+type Reclaimed struct {
+	Runs  int
+	Bytes int64
+}
+
+// CollectResult is the result of a collection.
+type CollectResult struct {
+	// Reclaimed is the reclaimed runs and bytes by reasons.
+	Reclaimed map[string]*Reclaimed
+	// Runs and Bytes are the number of runs and bytes that remain in the store.
+	Runs  int
+	Bytes int64
+}
+
+// Collect deletes runs in the store that violate the retention policy as of the
+// given time. Runs are checked against the max age first, then the max number
+// of runs per repository, and finally the max total size.
+func Collect(ctx context.Context, store Store, policy RetentionPolicy, now time.Time) (*CollectResult, error) {
+	entries, err := store.List(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list")
+	}
+
+	// Decide which runs to delete and for what reason, entries are from the
+	// oldest to the newest.
+	reasons := make(map[ulid.ULID]string, len(entries))
+	if policy.MaxAge > 0 {
+		for _, entry := range entries {
+			if now.Sub(ulid.Time(entry.ID.Time())) > policy.MaxAge {
+				reasons[entry.ID] = ReasonMaxAge
+			}
+		}
+	}
+	if policy.MaxRunsPerRepository > 0 {
+		kept := make(map[string]int)
+		for i := len(entries) - 1; i >= 0; i-- {
+			entry := entries[i]
+			if reasons[entry.ID] != "" {
+				continue
+			}
+			kept[entry.Repository]++
+			if kept[entry.Repository] > policy.MaxRunsPerRepository {
+				reasons[entry.ID] = ReasonMaxRunsPerRepository
+			}
+		}
+	}
+	if policy.MaxTotalSize > 0 {
+		var total int64
+		for _, entry := range entries {
+			if reasons[entry.ID] == "" {
+				total += entry.Size
+			}
+		}
+		for _, entry := range entries {
+			if total <= policy.MaxTotalSize {
+				break
+			}
+			if reasons[entry.ID] == "" {
+				reasons[entry.ID] = ReasonMaxTotalSize
+				total -= entry.Size
+			}
+		}
+	}
+
+	result := &CollectResult{
+		Reclaimed: make(map[string]*Reclaimed),
+	}
+	for _, entry := range entries {
+		reason := reasons[entry.ID]
+		if reason == "" {
+			result.Runs++
+			result.Bytes += entry.Size
+			continue
+		}
+
+		err = store.Delete(ctx, entry.ID)
+		if err != nil {
+			return result, errors.Wrapf(err, "delete run %s", entry.ID)
+		}
+		if result.Reclaimed[reason] == nil {
+			result.Reclaimed[reason] = &Reclaimed{}
+		}
+		result.Reclaimed[reason].Runs++
+		result.Reclaimed[reason].Bytes += entry.Size
+	}
+	return result, nil
+}
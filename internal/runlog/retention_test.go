@@ -0,0 +1,76 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package runlog
+
+import (
+	"context"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollect(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+	store := NewFileStore(t.TempDir())
+
+	// Runs from the oldest to the newest, all with the same size.
+	put := func(age time.Duration, repository string) ulid.ULID {
+		id := ulid.MustNew(ulid.Timestamp(now.Add(-age)), rand.Reader)
+		require.NoError(t, store.Put(ctx, id, &Metadata{Repository: repository}, []byte(strings.Repeat("x", 10))))
+		return id
+	}
+	expired := put(48*time.Hour, "a/a")
+	put(5*time.Hour, "a/a")
+	put(4*time.Hour, "b/b")
+	a2 := put(3*time.Hour, "a/a")
+	a3 := put(2*time.Hour, "a/a")
+	b2 := put(1*time.Hour, "b/b")
+
+	entries, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 6)
+	assert.Equal(t, expired, entries[0].ID)
+	assert.Equal(t, "a/a", entries[0].Repository)
+	size := entries[0].Size
+
+	result, err := Collect(
+		ctx,
+		store,
+		RetentionPolicy{
+			MaxAge:               24 * time.Hour,
+			MaxRunsPerRepository: 2,
+			MaxTotalSize:         3 * size,
+		},
+		now,
+	)
+	require.NoError(t, err)
+
+	want := &CollectResult{
+		Reclaimed: map[string]*Reclaimed{
+			ReasonMaxAge:               {Runs: 1, Bytes: size},
+			ReasonMaxRunsPerRepository: {Runs: 1, Bytes: size},
+			ReasonMaxTotalSize:         {Runs: 1, Bytes: size},
+		},
+		Runs:  3,
+		Bytes: 3 * size,
+	}
+	assert.Equal(t, want, result)
+
+	entries, err = store.List(ctx)
+	require.NoError(t, err)
+	var got []ulid.ULID
+	for _, entry := range entries {
+		got = append(got, entry.ID)
+	}
+	// The expired one is deleted by max age, the second oldest of "a/a" by max
+	// runs per repository, then the oldest of "b/b" by max total size.
+	assert.Equal(t, []ulid.ULID{a2, a3, b2}, got)
+}
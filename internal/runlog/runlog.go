@@ -0,0 +1,269 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package runlog stores logs of Codenotify runs, which are identified by ULIDs.
+package runlog
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+
+	"github.com/codenotify/codenotify.run/internal/codenotify"
+)
+
+// ErrNotExist is returned when the log of a run does not exist.
+var ErrNotExist = errors.New("run log does not exist")
+
+// NewID returns a new run ID, which is monotonically increasing within the
+// process.
+func NewID() ulid.ULID {
+	return ulid.Make()
+}
+
+// ParseID parses and validates the run ID, which must be a ULID in its
+// canonical string representation.
+func ParseID(s string) (ulid.ULID, error) {
+	id, err := ulid.ParseStrict(s)
+	if err != nil {
+		return ulid.ULID{}, errors.Wrapf(err, "parse %q", s)
+	} else if id.String() != s {
+		return ulid.ULID{}, errors.Errorf("%q is not in canonical form", s)
+	}
+	return id, nil
+}
+
+// Metadata is the metadata of a run, which is used to decide who can view the
+// log of the run and to show details of the run.
+type Metadata struct {
+	// Repository is the full name of the repository, e.g. "owner/name".
+	Repository    string `json:"repository"`
+	RepositoryID  int64  `json:"repository_id"`
+	RepositoryURL string `json:"repository_url,omitempty"`
+	// App is the name of the GitHub App that the run belongs to, which is empty
+	// for runs that predate multiple GitHub Apps, i.e. of the default app.
+	App string `json:"app,omitempty"`
+	// Private indicates whether the repository was private at the time of the
+	// run.
+	Private        bool   `json:"private"`
+	InstallationID int64  `json:"installation_id"`
+	PullRequest    int    `json:"pull_request"`
+	PullRequestURL string `json:"pull_request_url,omitempty"`
+	BaseSHA        string `json:"base_sha,omitempty"`
+	HeadSHA        string `json:"head_sha,omitempty"`
+	// Trigger is the event that triggered the run, e.g. "pull_request.opened".
+	Trigger string `json:"trigger,omitempty"`
+	// InProgress indicates whether the run is still in progress, i.e. the log is
+	// incomplete.
+	InProgress  bool      `json:"in_progress,omitempty"`
+	StartedAt   time.Time `json:"started_at,omitzero"`
+	CompletedAt time.Time `json:"completed_at,omitzero"`
+	// Phases is the list of phases of the run in the order they started.
+	Phases []Phase `json:"phases,omitempty"`
+	// State is the final state of the run, e.g. "success", it is empty while the
+	// run is in progress.
+	State string `json:"state,omitempty"`
+	// Report is the report of Codenotify, only available when the run succeeded.
+	Report *codenotify.Report `json:"report,omitempty"`
+}
+
+// Duration returns the duration of the run, or the elapsed time since the run
+// started if the run is in progress.
+func (m *Metadata) Duration() time.Duration {
+	return duration(m.StartedAt, m.CompletedAt)
+}
+
+// Phase is a phase of a run, e.g. "clone".
+type Phase struct {
+	Name        string    `json:"name"`
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at,omitzero"`
+}
+
+// Duration returns the duration of the phase, or the elapsed time since the
+// phase started if the phase is in progress.
+func (p *Phase) Duration() time.Duration {
+	return duration(p.StartedAt, p.CompletedAt)
+}
+
+func duration(startedAt, completedAt time.Time) time.Duration {
+	if startedAt.IsZero() {
+		return 0
+	} else if completedAt.IsZero() {
+		return time.Since(startedAt)
+	}
+	return completedAt.Sub(startedAt)
+}
+
+// Store is the storage of run logs.
+type Store interface {
+	// Put saves the metadata and the log of the run, it overwrites the existing
+	// ones if any. The log is saved before the metadata, thus the log read after
+	// the metadata is at least as new as the metadata.
+	Put(ctx context.Context, id ulid.ULID, meta *Metadata, data []byte) error
+	// Metadata returns the metadata of the run. It returns ErrNotExist when the
+	// metadata does not exist.
+	Metadata(ctx context.Context, id ulid.ULID) (*Metadata, error)
+	// Get returns the log of the run. It returns ErrNotExist when the log does
+	// not exist.
+	Get(ctx context.Context, id ulid.ULID) ([]byte, error)
+	// List returns all runs in the store ordered by their IDs, i.e. from the
+	// oldest to the newest.
+	List(ctx context.Context) ([]*Entry, error)
+	// Delete deletes the metadata and the log of the run, it is a no-op when the
+	// run does not exist.
+	Delete(ctx context.Context, id ulid.ULID) error
+}
+
+// Entry is a run in the store.
+type Entry struct {
+	ID ulid.ULID
+	// Size is the total size of the metadata and the log in bytes.
+	Size int64
+	// Repository is the full name of the repository, it is empty when the run has
+	// no metadata.
+	Repository string
+}
+
+var _ Store = (*FileStore)(nil)
+
+// FileStore stores run logs as files in a directory of the local file system.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a new store that saves run logs in the given directory.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+// path returns the path of the file of the run with the extension. Paths are
+// always derived from the canonical string representation of the ID, which
+// only consists of characters of Crockford's Base32, thus never escape the
+// directory.
+func (s *FileStore) path(id ulid.ULID, ext string) string {
+	return filepath.Join(s.dir, id.String()+ext)
+}
+
+func (s *FileStore) Put(_ context.Context, id ulid.ULID, meta *Metadata, data []byte) error {
+	err := os.MkdirAll(s.dir, os.ModePerm)
+	if err != nil {
+		return errors.Wrap(err, "create directory")
+	}
+
+	metadata, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Wrap(err, "encode metadata")
+	}
+	err = writeFile(s.path(id, ".log"), data)
+	if err != nil {
+		return errors.Wrap(err, "write log")
+	}
+	return writeFile(s.path(id, ".json"), metadata)
+}
+
+// writeFile writes the data to a temporary file then renames it to the named
+// file, thus readers never see a partially written file while the log of a run
+// in progress is being overwritten.
+func writeFile(name string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	_, err = f.Write(data)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+func (s *FileStore) Metadata(_ context.Context, id ulid.ULID) (*Metadata, error) {
+	data, err := os.ReadFile(s.path(id, ".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+
+	var meta Metadata
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode metadata")
+	}
+	return &meta, nil
+}
+
+func (s *FileStore) Get(_ context.Context, id ulid.ULID) ([]byte, error) {
+	data, err := os.ReadFile(s.path(id, ".log"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	return data, err
+}
+
+func (s *FileStore) List(ctx context.Context) ([]*Entry, error) {
+	dirEntries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "read directory")
+	}
+
+	// Files are grouped by runs, and os.ReadDir returns entries sorted by names
+	// thus also by IDs.
+	var entries []*Entry
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		ext := filepath.Ext(name)
+		if ext != ".log" && ext != ".json" {
+			continue
+		}
+		id, err := ParseID(strings.TrimSuffix(name, ext))
+		if err != nil {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Deleted concurrently
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "stat %q", name)
+		}
+
+		if len(entries) == 0 || entries[len(entries)-1].ID != id {
+			entries = append(entries, &Entry{ID: id})
+		}
+		entry := entries[len(entries)-1]
+		entry.Size += info.Size()
+		if ext == ".json" {
+			meta, err := s.Metadata(ctx, id)
+			if err == nil {
+				entry.Repository = meta.Repository
+			}
+		}
+	}
+	return entries, nil
+}
+
+func (s *FileStore) Delete(_ context.Context, id ulid.ULID) error {
+	for _, ext := range []string{".json", ".log"} {
+		err := os.Remove(s.path(id, ext))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package runlog
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseID(t *testing.T) {
+	id := NewID()
+	got, err := ParseID(id.String())
+	require.NoError(t, err)
+	assert.Equal(t, id, got)
+
+	tests := []string{
+		"",
+		"not-a-ulid",
+		"../../etc/passwd",
+		"..%2F..%2Fetc%2Fpasswd",
+		"01GA6V8X8JQ0D2XK1D3V3R6TSE/..",
+		"01GA6V8X8JQ0D2XK1D3V3R6TS",   // Too short
+		"01GA6V8X8JQ0D2XK1D3V3R6TSEE", // Too long
+		"01GA6V8X8JQ0D2XK1D3V3R6TSU",  // Invalid character
+		"81GA6V8X8JQ0D2XK1D3V3R6TSE",  // Overflow
+		strings.ToLower(id.String()),  // Not canonical
+	}
+	for _, test := range tests {
+		t.Run(test, func(t *testing.T) {
+			_, err := ParseID(test)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// testStore tests the behaviors that every store implementation should have.
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	id := NewID()
+	_, err := store.Get(ctx, id)
+	assert.Equal(t, ErrNotExist, err)
+	_, err = store.Metadata(ctx, id)
+	assert.Equal(t, ErrNotExist, err)
+
+	meta := &Metadata{
+		Repository:     "codenotify/codenotify.run",
+		RepositoryID:   1,
+		Private:        true,
+		InstallationID: 2,
+		PullRequest:    3,
+	}
+	require.NoError(t, store.Put(ctx, id, meta, []byte("git fetch")))
+	got, err := store.Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "git fetch", string(got))
+	gotMeta, err := store.Metadata(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, meta, gotMeta)
+
+	id2 := NewID()
+	require.NoError(t, store.Put(ctx, id2, &Metadata{Repository: "codenotify/other"}, []byte("git diff")))
+	entries, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, id, entries[0].ID)
+	assert.Equal(t, "codenotify/codenotify.run", entries[0].Repository)
+	assert.Greater(t, entries[0].Size, int64(len("git fetch")))
+	assert.Equal(t, id2, entries[1].ID)
+	assert.Equal(t, "codenotify/other", entries[1].Repository)
+
+	require.NoError(t, store.Delete(ctx, id))
+	_, err = store.Get(ctx, id)
+	assert.Equal(t, ErrNotExist, err)
+	_, err = store.Metadata(ctx, id)
+	assert.Equal(t, ErrNotExist, err)
+	require.NoError(t, store.Delete(ctx, id), "delete non-existent run")
+
+	entries, err = store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, id2, entries[0].ID)
+}
+
+func TestFileStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "runs")
+	store := NewFileStore(dir)
+	testStore(t, store)
+
+	// Logs should never be written outside of the directory.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		_, err = ParseID(strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())))
+		assert.NoError(t, err, entry.Name())
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package runlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+)
+
+// S3Options contains the options of an S3-compatible object storage.
+type S3Options struct {
+	// Endpoint is the host (and port) of the storage, e.g. "s3.amazonaws.com".
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// UseSSL indicates whether to use HTTPS to connect to the storage.
+	UseSSL bool
+	// Prefix is the prefix of object names, e.g. "runs/".
+	Prefix string
+}
+
+var _ Store = (*S3Store)(nil)
+
+// S3Store stores run logs as objects in an S3-compatible object storage, which
+// makes them available to every replica of the server.
+type S3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Store returns a new store that saves run logs in the S3-compatible object
+// storage. The bucket must exist.
+func NewS3Store(opts S3Options) (*S3Store, error) {
+	client, err := minio.New(
+		opts.Endpoint,
+		&minio.Options{
+			Creds:  credentials.NewStaticV4(opts.AccessKeyID, opts.SecretAccessKey, ""),
+			Secure: opts.UseSSL,
+			Region: opts.Region,
+		},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "new client")
+	}
+	return &S3Store{
+		client: client,
+		bucket: opts.Bucket,
+		prefix: opts.Prefix,
+	}, nil
+}
+
+// objectName returns the name of the object of the run with the extension,
+// which is always derived from the canonical string representation of the ID.
+func (s *S3Store) objectName(id ulid.ULID, ext string) string {
+	return s.prefix + id.String() + ext
+}
+
+func (s *S3Store) putObject(ctx context.Context, name, contentType string, data []byte) error {
+	_, err := s.client.PutObject(
+		ctx,
+		s.bucket,
+		name,
+		bytes.NewReader(data),
+		int64(len(data)),
+		minio.PutObjectOptions{
+			ContentType: contentType,
+		},
+	)
+	return err
+}
+
+func (s *S3Store) Put(ctx context.Context, id ulid.ULID, meta *Metadata, data []byte) error {
+	metadata, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Wrap(err, "encode metadata")
+	}
+	err = s.putObject(ctx, s.objectName(id, ".log"), "text/plain; charset=utf-8", data)
+	if err != nil {
+		return errors.Wrap(err, "put log")
+	}
+	err = s.putObject(ctx, s.objectName(id, ".json"), "application/json", metadata)
+	if err != nil {
+		return errors.Wrap(err, "put metadata")
+	}
+	return nil
+}
+
+// getObject returns the content of the object. It returns ErrNotExist when the
+// object does not exist.
+func (s *S3Store) getObject(ctx context.Context, name string) ([]byte, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = obj.Close() }()
+
+	// NOTE: The request is only sent upon the first read.
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *S3Store) Metadata(ctx context.Context, id ulid.ULID) (*Metadata, error) {
+	data, err := s.getObject(ctx, s.objectName(id, ".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var meta Metadata
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode metadata")
+	}
+	return &meta, nil
+}
+
+func (s *S3Store) Get(ctx context.Context, id ulid.ULID) ([]byte, error) {
+	return s.getObject(ctx, s.objectName(id, ".log"))
+}
+
+func (s *S3Store) List(ctx context.Context) ([]*Entry, error) {
+	// Objects are grouped by runs, and are listed in lexicographical order of
+	// names thus also by IDs.
+	var entries []*Entry
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix}) {
+		if obj.Err != nil {
+			return nil, errors.Wrap(obj.Err, "list objects")
+		}
+
+		name := strings.TrimPrefix(obj.Key, s.prefix)
+		ext := path.Ext(name)
+		if ext != ".log" && ext != ".json" {
+			continue
+		}
+		id, err := ParseID(strings.TrimSuffix(name, ext))
+		if err != nil {
+			continue
+		}
+
+		if len(entries) == 0 || entries[len(entries)-1].ID != id {
+			entries = append(entries, &Entry{ID: id})
+		}
+		entry := entries[len(entries)-1]
+		entry.Size += obj.Size
+		if ext == ".json" {
+			meta, err := s.Metadata(ctx, id)
+			if err == nil {
+				entry.Repository = meta.Repository
+			}
+		}
+	}
+	return entries, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, id ulid.ULID) error {
+	for _, ext := range []string{".json", ".log"} {
+		// NOTE: Removing a non-existent object is not an error in S3.
+		err := s.client.RemoveObject(ctx, s.bucket, s.objectName(id, ext), minio.RemoveObjectOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package runlog
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/require"
+)
+
+// TestS3Store runs against a local MinIO (or any S3-compatible storage), e.g.
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	TEST_S3_ENDPOINT=localhost:9000 go test ./internal/runlog -run TestS3Store
+func TestS3Store(t *testing.T) {
+	endpoint := os.Getenv("TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("TEST_S3_ENDPOINT is not set")
+	}
+	getenv := func(key, defaultValue string) string {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+		return defaultValue
+	}
+
+	store, err := NewS3Store(
+		S3Options{
+			Endpoint:        endpoint,
+			Region:          getenv("TEST_S3_REGION", "us-east-1"),
+			Bucket:          getenv("TEST_S3_BUCKET", "codenotify-test"),
+			AccessKeyID:     getenv("TEST_S3_ACCESS_KEY_ID", "minioadmin"),
+			SecretAccessKey: getenv("TEST_S3_SECRET_ACCESS_KEY", "minioadmin"),
+			// Every test run uses a new prefix to not see objects of previous runs.
+			Prefix: "runs-" + NewID().String() + "/",
+		},
+	)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	exists, err := store.client.BucketExists(ctx, store.bucket)
+	require.NoError(t, err)
+	if !exists {
+		require.NoError(t, store.client.MakeBucket(ctx, store.bucket, minio.MakeBucketOptions{}))
+	}
+
+	testStore(t, store)
+	t.Cleanup(func() {
+		entries, err := store.List(ctx)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			require.NoError(t, store.Delete(ctx, entry.ID))
+		}
+	})
+}
@@ -0,0 +1,232 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package runlog
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+
+	"github.com/codenotify/codenotify.run/internal/codenotify"
+)
+
+// Redacted is the replacement of secrets in run logs.
+const Redacted = "<REDACTED>"
+
+const (
+	// flushBackoffSize is the size of the log for every which the interval of
+	// saving a run in progress is extended by another interval, because the
+	// whole log is saved every time.
+	flushBackoffSize = 256 << 10
+	// maxFlushInterval is the maximum interval of saving a run in progress.
+	maxFlushInterval = 30 * time.Second
+)
+
+// flushInterval returns the interval of saving a run in progress with the log
+// of given size, which backs off as the log grows.
+func flushInterval(interval time.Duration, size int) time.Duration {
+	return min(interval*time.Duration(1+size/flushBackoffSize), max(interval, maxFlushInterval))
+}
+
+// Writer streams the log of a run to the store while the run is in progress.
+// Secrets are redacted before anything reaches the store.
+type Writer struct {
+	store Store
+	id    ulid.ULID
+	meta  Metadata
+
+	secrets [][]byte
+	stop    chan struct{}
+	stopped chan struct{}
+	flushMu sync.Mutex // Serializes saves to the store
+
+	mu sync.Mutex
+	// buf is the redacted log that is safe to be saved.
+	buf bytes.Buffer
+	// pending is the end of the written data that may be the beginning of a
+	// secret, it is held back until the next write tells otherwise.
+	pending []byte
+	dirty   bool
+	closed  bool
+	// flushedAt is the time of the last successful save.
+	flushedAt time.Time
+}
+
+// NewWriter returns a new writer that saves the log of the run to the store
+// with the metadata right away, and then every given interval when there is new
+// output, which is extended for large logs. Every occurrence of the secrets is
+// replaced by Redacted. The run is marked as in progress until the writer is
+// closed.
+func NewWriter(ctx context.Context, store Store, id ulid.ULID, meta *Metadata, secrets []string, interval time.Duration) *Writer {
+	w := &Writer{
+		store:   store,
+		id:      id,
+		meta:    *meta,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	w.meta.InProgress = true
+	w.meta.StartedAt = time.Now()
+	for _, secret := range secrets {
+		if secret != "" {
+			w.secrets = append(w.secrets, []byte(secret))
+		}
+	}
+
+	w.dirty = true
+	_ = w.Flush(ctx)
+	go w.flushLoop(ctx, interval)
+	return w
+}
+
+func (w *Writer) flushLoop(ctx context.Context, interval time.Duration) {
+	defer close(w.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			due := time.Since(w.flushedAt) >= flushInterval(interval, w.buf.Len())
+			w.mu.Unlock()
+			if due {
+				_ = w.Flush(ctx)
+			}
+		}
+	}
+}
+
+// redact replaces every secret in the data.
+func (w *Writer) redact(data []byte) []byte {
+	for _, secret := range w.secrets {
+		data = bytes.ReplaceAll(data, secret, []byte(Redacted))
+	}
+	return data
+}
+
+// heldBack returns the length of the longest end of the data that is the
+// beginning of any secret.
+func (w *Writer) heldBack(data []byte) int {
+	var n int
+	for _, secret := range w.secrets {
+		for i := min(len(secret)-1, len(data)); i > n; i-- {
+			if bytes.HasSuffix(data, secret[:i]) {
+				n = i
+				break
+			}
+		}
+	}
+	return n
+}
+
+// Write writes the output of the run. It never fails so that the run is not
+// interrupted by failures of the store, which are reported by Flush and Close
+// instead.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return len(p), nil
+	}
+
+	data := w.redact(append(w.pending, p...))
+	n := w.heldBack(data)
+	w.buf.Write(data[:len(data)-n])
+	w.pending = append([]byte(nil), data[len(data)-n:]...)
+	w.dirty = true
+	return len(p), nil
+}
+
+// Flush saves the log to the store if there is new output since the last save.
+func (w *Writer) Flush(ctx context.Context) error {
+	// NOTE: Saving can be slow, the lock of data is not held meanwhile so that
+	// writes of the run are not blocked.
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	if !w.dirty {
+		w.mu.Unlock()
+		return nil
+	}
+	meta := w.meta
+	meta.Phases = append([]Phase(nil), w.meta.Phases...)
+	data := append([]byte(nil), w.buf.Bytes()...)
+	w.dirty = false
+	w.mu.Unlock()
+
+	err := w.store.Put(ctx, w.id, &meta, data)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		w.dirty = true
+		return err
+	}
+	w.flushedAt = time.Now()
+	return nil
+}
+
+// StartPhase records the start of the phase of the run, and returns the function
+// to record the end of the phase.
+func (w *Writer) StartPhase(name string) (end func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	i := len(w.meta.Phases)
+	w.meta.Phases = append(w.meta.Phases, Phase{Name: name, StartedAt: time.Now()})
+	w.dirty = true
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.meta.Phases[i].CompletedAt = time.Now()
+		w.dirty = true
+	}
+}
+
+// SetOutcome sets the final state and the report of the run, which are saved
+// upon closing.
+func (w *Writer) SetOutcome(state string, report *codenotify.Report) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.meta.State = state
+	w.meta.Report = report
+}
+
+// Close marks the run as finished and saves the complete log to the store.
+func (w *Writer) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	close(w.stop)
+	<-w.stopped
+
+	w.mu.Lock()
+	// A held back end that never turned into a secret is safe to be saved.
+	w.buf.Write(w.pending)
+	w.pending = nil
+	w.meta.InProgress = false
+	w.meta.CompletedAt = time.Now()
+	// Phases that never ended (e.g. failed) end with the run.
+	for i := range w.meta.Phases {
+		if w.meta.Phases[i].CompletedAt.IsZero() {
+			w.meta.Phases[i].CompletedAt = w.meta.CompletedAt
+		}
+	}
+	w.dirty = true
+	w.mu.Unlock()
+	return w.Flush(ctx)
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package runlog
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileStore(t.TempDir())
+	id := NewID()
+	const token = "ghs_secret"
+
+	w := NewWriter(ctx, store, id, &Metadata{Repository: "codenotify/codenotify.run"}, []string{token, ""}, time.Hour)
+
+	// The run is available as soon as it starts.
+	meta, err := store.Metadata(ctx, id)
+	require.NoError(t, err)
+	assert.True(t, meta.InProgress)
+	assert.Equal(t, "codenotify/codenotify.run", meta.Repository)
+
+	// The token is split across writes.
+	_, _ = fmt.Fprint(w, "git clone https://x-access-token:ghs_")
+	require.NoError(t, w.Flush(ctx))
+	got, err := store.Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "git clone https://x-access-token:", string(got))
+
+	_, _ = fmt.Fprint(w, "secret@github.com/codenotify/codenotify.run\n")
+	_, _ = fmt.Fprint(w, "git fetch ghs_")
+	require.NoError(t, w.Flush(ctx))
+	got, err = store.Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "git clone https://x-access-token:<REDACTED>@github.com/codenotify/codenotify.run\ngit fetch ", string(got))
+
+	endClone := w.StartPhase("clone")
+	endClone()
+	_ = w.StartPhase("codenotify") // Never ended
+	w.SetOutcome("error", nil)
+	require.NoError(t, w.Close(ctx))
+	meta, err = store.Metadata(ctx, id)
+	require.NoError(t, err)
+	assert.False(t, meta.InProgress)
+	assert.Equal(t, "error", meta.State)
+	assert.False(t, meta.StartedAt.IsZero())
+	assert.False(t, meta.CompletedAt.IsZero())
+	require.Len(t, meta.Phases, 2)
+	assert.Equal(t, "clone", meta.Phases[0].Name)
+	assert.Equal(t, "codenotify", meta.Phases[1].Name)
+	assert.Equal(t, meta.CompletedAt, meta.Phases[1].CompletedAt, "unfinished phase should end with the run")
+	got, err = store.Get(ctx, id)
+	require.NoError(t, err)
+	// The held back end turned out not to be the token.
+	assert.Equal(t, "git clone https://x-access-token:<REDACTED>@github.com/codenotify/codenotify.run\ngit fetch ghs_", string(got))
+
+	// Writes after closing are discarded.
+	_, _ = fmt.Fprint(w, "ghs_secret")
+	require.NoError(t, w.Close(ctx))
+	got, err = store.Get(ctx, id)
+	require.NoError(t, err)
+	assert.NotContains(t, string(got), token)
+}
+
+// countingStore is a Store that counts the number of saves.
+type countingStore struct {
+	Store
+	puts int
+}
+
+func (s *countingStore) Put(ctx context.Context, id ulid.ULID, meta *Metadata, data []byte) error {
+	s.puts++
+	return s.Store.Put(ctx, id, meta, data)
+}
+
+func TestWriter_Flush(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{Store: NewFileStore(t.TempDir())}
+	w := NewWriter(ctx, store, NewID(), &Metadata{Repository: "codenotify/codenotify.run"}, nil, time.Hour)
+	assert.Equal(t, 1, store.puts)
+
+	// Nothing is saved without new output.
+	require.NoError(t, w.Flush(ctx))
+	assert.Equal(t, 1, store.puts)
+
+	_, _ = fmt.Fprint(w, "git fetch\n")
+	require.NoError(t, w.Flush(ctx))
+	require.NoError(t, w.Flush(ctx))
+	assert.Equal(t, 2, store.puts)
+	require.NoError(t, w.Close(ctx))
+}
+
+func TestFlushInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		size     int
+		want     time.Duration
+	}{
+		{name: "small log", interval: time.Second, size: 1 << 10, want: time.Second},
+		{name: "large log", interval: time.Second, size: 1 << 20, want: 5 * time.Second},
+		{name: "huge log", interval: time.Second, size: 100 << 20, want: maxFlushInterval},
+		{name: "long interval", interval: time.Minute, size: 100 << 20, want: time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, flushInterval(test.interval, test.size))
+		})
+	}
+}
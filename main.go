@@ -6,18 +6,14 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"os"
 
 	"github.com/flamego/flamego"
-	"github.com/google/go-github/v45/github"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "unknwon.dev/clog/v2"
 
 	"github.com/codenotify/codenotify.run/internal/conf"
-	"github.com/codenotify/codenotify.run/internal/osutil"
+	"github.com/codenotify/codenotify.run/internal/queue"
+	"github.com/codenotify/codenotify.run/internal/repoconf"
 )
 
 func main() {
@@ -36,65 +32,77 @@ func main() {
 		log.Fatal("Failed to load configuration: %v", err)
 	}
 
-	f := flamego.Classic()
-	f.Get("/", func(c flamego.Context) {
-		c.Redirect("https://github.com/codenotify/codenotify.run")
-	})
-	f.Get("/runs/{runID}", func(c flamego.Context) ([]byte, error) {
-		logPath := logPathByRunID(config.Server.LogsRootDir, c.Param("runID"))
-		if !osutil.IsFile(logPath) {
-			return []byte("The run log no longer exists"), nil
-		}
-		return os.ReadFile(logPath)
-	})
-
-	f.Post("/-/webhook", func(r *http.Request) (int, string) {
-		event := r.Header.Get("X-GitHub-Event")
-		log.Trace("Received event: %s", event)
-
-		if event != "pull_request" {
-			return http.StatusOK, fmt.Sprintf("Event %q has been received but nothing to do", event)
-		}
-
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			return http.StatusInternalServerError, fmt.Sprintf("Failed to read request body: %v", err)
-		}
+	q, err := queue.Open(config.Queue.Path, config.Queue.DeliveryTTL)
+	if err != nil {
+		log.Fatal("Failed to open queue: %v", err)
+	}
+	store, err := newRunStore(config)
+	if err != nil {
+		log.Fatal("Failed to create run log store: %v", err)
+	}
+	db, err := openRunDB(context.Background(), config)
+	if err != nil {
+		log.Fatal("Failed to open run history database: %v", err)
+	}
 
-		if config.GitHubApp.WebhookSecret != "" {
-			ok, err := validateGitHubWebhookSignature256(r.Header.Get("X-Hub-Signature-256"), config.GitHubApp.WebhookSecret, body)
-			if err != nil {
-				return http.StatusInternalServerError, fmt.Sprintf("Failed to validate signature: %v", err)
-			} else if !ok {
-				return http.StatusBadRequest, `Mismatched payload signature for "X-Hub-Signature-256"`
-			}
-		}
+	apps := newGitHubApps(config)
+	runs := newRunRegistry()
+	startWorkers(context.Background(), config, apps, q, runs, store, db)
+	go purgeExpiredDeliveries(context.Background(), q)
+	go collectRunLogs(context.Background(), config, store)
 
-		var payload github.PullRequestEvent
-		err = json.Unmarshal(body, &payload)
-		if err != nil {
-			return http.StatusBadRequest, fmt.Sprintf("Failed to decode payload: %v", err)
-		}
-		if payload.Installation == nil || payload.Installation.ID == nil {
-			return http.StatusBadRequest, "No installation or installation ID"
-		} else if payload.Action == nil {
-			return http.StatusBadRequest, "No action"
-		}
+	f := flamego.Classic()
+	f.Get("/codenotify.schema.json", func(c flamego.Context) []byte {
+		c.ResponseWriter().Header().Set("Content-Type", "application/schema+json")
+		return repoconf.Schema
+	})
 
-		if payload.PullRequest.Draft != nil && *payload.PullRequest.Draft {
-			return http.StatusOK, "Skip draft pull request"
+	sessioner, err := newSessioner(config)
+	if err != nil {
+		log.Fatal("Failed to create session store: %v", err)
+	}
+	for _, app := range apps {
+		if app.oauth == nil {
+			log.Warn("GitHub OAuth is not configured for GitHub App %q, run logs of its private repositories are not available", app.Name)
 		}
+	}
+	f.Group("/-/oauth", func() {
+		f.Get("/login", handleOAuthLogin(apps))
+		f.Get("/callback", handleOAuthCallback(apps))
+	}, sessioner)
+	f.Get("/runs/{runID}", sessioner, handleRunLog(store, apps, checkRepoAccess))
+
+	if config.Admin.Token == "" {
+		log.Warn(`Admin API, dashboard and metrics are disabled because "[admin] TOKEN" is not set`)
+		f.Get("/", func(c flamego.Context) {
+			c.Redirect("https://github.com/codenotify/codenotify.run")
+		})
+	} else {
+		f.Get("/", sessioner, handleDashboard(db, q))
+		f.Group("/-/admin", func() {
+			f.Combo("/login").Get(handleAdminLogin(config.Admin.Token)).Post(handleAdminLogin(config.Admin.Token))
+			f.Post("/logout", handleAdminLogout)
+		}, sessioner)
+
+		f.Group("/api/v1", func() {
+			f.Get("/runs", handleAPIListRuns(config, db))
+			f.Get("/runs/{runID}", handleAPIGetRun(config, db))
+			f.Post("/repos/{owner}/{repo}/pulls/{number}/rerun", handleAPIRerun(q, runs, findPullRequest(apps)))
+			f.Get("/installations", handleAPIListInstallations(db, listInstallations(apps)))
+		}, apiAuth(config.Admin.Token))
+
+		// NOTE: Metrics are labelled with installations and repositories, thus
+		// must not be public.
+		f.Get("/-/metrics", apiAuth(config.Admin.Token), promhttp.Handler().ServeHTTP)
+	}
 
-		switch *payload.Action {
-		case "opened", "ready_for_review":
-			go reportCommitStatus(context.Background(), config, &payload, handlePullRequestOpen)
-		case "synchronize", "reopened":
-			go reportCommitStatus(context.Background(), config, &payload, handlePullRequestSynchronize)
-		default:
-			return http.StatusOK, fmt.Sprintf("Event %q with action %q has been received but nothing to do", event, *payload.Action)
+	webhook := handleWebhook(apps, q, runs)
+	f.Post("/-/webhook", webhook)
+	for _, app := range apps {
+		if app.WebhookPath != "" {
+			f.Post(app.WebhookPath, webhook)
 		}
-		return http.StatusAccepted, http.StatusText(http.StatusAccepted)
-	})
+	}
 
 	log.Info("Available on %s", config.Server.ExternalURL)
 	f.Run()
@@ -0,0 +1,53 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "codenotify"
+
+var (
+	runLogsReclaimedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "run_logs_reclaimed_total",
+			Help:      "The total number of run logs deleted by the retention policy.",
+		},
+		[]string{"reason"},
+	)
+	runLogsReclaimedBytesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "run_logs_reclaimed_bytes_total",
+			Help:      "The total size in bytes of run logs deleted by the retention policy.",
+		},
+		[]string{"reason"},
+	)
+	runLogsRetained = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "run_logs_retained",
+			Help:      "The number of run logs retained after the last collection.",
+		},
+	)
+	runLogsRetainedBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "run_logs_retained_bytes",
+			Help:      "The total size in bytes of run logs retained after the last collection.",
+		},
+	)
+	githubRateLimitRemaining = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "github_rate_limit_remaining",
+			Help:      "The number of requests remaining in the current rate limit window of the GitHub API.",
+		},
+		[]string{"installation_id"},
+	)
+)
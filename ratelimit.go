@@ -0,0 +1,161 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+	"github.com/pkg/errors"
+	log "unknwon.dev/clog/v2"
+)
+
+const (
+	// maxRateLimitRetries is the maximum number of times to retry a request that
+	// hit rate limits.
+	maxRateLimitRetries = 3
+	// maxRateLimitWait is the longest time to wait in place for rate limits to
+	// reset, the job is requeued instead when it takes longer.
+	maxRateLimitWait = time.Minute
+	// defaultSecondaryRateLimitWait is the time to wait for secondary rate limits
+	// without the "Retry-After" header, as recommended by GitHub.
+	defaultSecondaryRateLimitWait = time.Minute
+)
+
+// rateLimitTransport is an HTTP transport that is aware of GitHub rate limits.
+// Idempotent requests that hit rate limits are retried after the limits reset
+// when it is soon enough, otherwise the response is returned as-is.
+type rateLimitTransport struct {
+	base http.RoundTripper
+	// installationID is the ID of the installation that requests are made as, or
+	// 0 when made as the GitHub App itself.
+	installationID int64
+}
+
+// newRateLimitTransport returns a new rate limit aware transport of requests
+// made as the installation, or as the GitHub App itself when the installation
+// ID is 0.
+func newRateLimitTransport(base http.RoundTripper, installationID int64) *rateLimitTransport {
+	return &rateLimitTransport{
+		base:           base,
+		installationID: installationID,
+	}
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if t.installationID > 0 {
+			remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+			if err == nil {
+				githubRateLimitRemaining.WithLabelValues(strconv.FormatInt(t.installationID, 10)).Set(float64(remaining))
+			}
+		}
+
+		wait, limited := rateLimitWait(resp)
+		if !limited || attempt > maxRateLimitRetries || wait > maxRateLimitWait || !isRetryable(req) {
+			return resp, nil
+		}
+
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		log.Trace("Retrying %s %s in %s after hitting rate limits", req.Method, req.URL.Path, wait)
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, errors.Wrap(err, "get request body")
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// isRetryable returns true if the request is idempotent and can be sent again.
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// rateLimitWait returns how long to wait before sending the request again if
+// the response indicates that rate limits have been hit.
+func rateLimitWait(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	// Secondary rate limits.
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	// Primary rate limits.
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil {
+			return defaultSecondaryRateLimitWait, true
+		}
+		return max(time.Until(time.Unix(reset, 0)), 0), true
+	}
+
+	// Secondary rate limits are not always accompanied by the "Retry-After"
+	// header, which can only be told by the message.
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err == nil && bytes.Contains(bytes.ToLower(body), []byte("secondary rate limit")) {
+		return defaultSecondaryRateLimitWait, true
+	}
+	return 0, false
+}
+
+// rateLimitedUntil returns the time when the rate limits reset if the error is
+// caused by hitting rate limits.
+func rateLimitedUntil(err error) (time.Time, bool) {
+	var rateLimitErr *github.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return rateLimitErr.Rate.Reset.Time, true
+	}
+
+	var abuseRateLimitErr *github.AbuseRateLimitError
+	if errors.As(err, &abuseRateLimitErr) {
+		if abuseRateLimitErr.RetryAfter == nil {
+			return time.Now().Add(defaultSecondaryRateLimitWait), true
+		}
+		return time.Now().Add(*abuseRateLimitErr.RetryAfter), true
+	}
+
+	var errResp *github.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response != nil {
+		if wait, ok := rateLimitWait(errResp.Response); ok {
+			return time.Now().Add(wait), true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,166 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitTransport(t *testing.T) {
+	// Each request is answered by the next response in the list, and the last one
+	// is repeated.
+	var responses []func(w http.ResponseWriter)
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		respond := responses[min(requests, len(responses)-1)]
+		requests++
+		respond(w)
+	}))
+	t.Cleanup(server.Close)
+
+	newClient := func(t *testing.T) *github.Client {
+		client := github.NewClient(&http.Client{Transport: newRateLimitTransport(http.DefaultTransport, 42)})
+		baseURL, err := url.Parse(server.URL + "/")
+		require.NoError(t, err)
+		client.BaseURL = baseURL
+		return client
+	}
+	ok := func(w http.ResponseWriter) {
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		_, _ = w.Write([]byte(`[]`))
+	}
+	primaryLimited := func(reset time.Time) func(w http.ResponseWriter) {
+		return func(w http.ResponseWriter) {
+			w.Header().Set("X-RateLimit-Limit", "5000")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"message":"API rate limit exceeded"}`))
+		}
+	}
+	secondaryLimited := func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"message":"You have exceeded a secondary rate limit"}`))
+	}
+
+	t.Run("retry idempotent requests", func(t *testing.T) {
+		responses = []func(w http.ResponseWriter){primaryLimited(time.Now()), secondaryLimited, ok}
+		requests = 0
+		_, _, err := newClient(t).Issues.ListComments(context.Background(), "codenotify", "codenotify.run", 1, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 3, requests)
+		assert.Equal(t, float64(4999), testutil.ToFloat64(githubRateLimitRemaining.WithLabelValues("42")))
+	})
+
+	t.Run("give up after max retries", func(t *testing.T) {
+		responses = []func(w http.ResponseWriter){secondaryLimited}
+		requests = 0
+		_, _, err := newClient(t).Issues.ListComments(context.Background(), "codenotify", "codenotify.run", 1, nil)
+		require.Error(t, err)
+		assert.Equal(t, maxRateLimitRetries+1, requests)
+		_, limited := rateLimitedUntil(errors.Wrap(err, "list comments"))
+		assert.True(t, limited)
+	})
+
+	t.Run("do not retry non-idempotent requests", func(t *testing.T) {
+		reset := time.Now()
+		responses = []func(w http.ResponseWriter){primaryLimited(reset), ok}
+		requests = 0
+		_, _, err := newClient(t).Issues.CreateComment(context.Background(), "codenotify", "codenotify.run", 1, &github.IssueComment{Body: github.String("Hello")})
+		require.Error(t, err)
+		assert.Equal(t, 1, requests)
+		until, limited := rateLimitedUntil(errors.Wrap(err, "create comment"))
+		assert.True(t, limited)
+		assert.Equal(t, reset.Unix(), until.Unix())
+	})
+
+	t.Run("do not wait too long", func(t *testing.T) {
+		reset := time.Now().Add(time.Hour)
+		responses = []func(w http.ResponseWriter){primaryLimited(reset), ok}
+		requests = 0
+		_, _, err := newClient(t).Issues.ListComments(context.Background(), "codenotify", "codenotify.run", 1, nil)
+		require.Error(t, err)
+		assert.Equal(t, 1, requests)
+		until, limited := rateLimitedUntil(errors.Wrap(err, "list comments"))
+		assert.True(t, limited)
+		assert.Equal(t, reset.Unix(), until.Unix())
+	})
+}
+
+func TestRateLimitWait(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		header      http.Header
+		body        string
+		wantWait    time.Duration
+		wantLimited bool
+	}{
+		{
+			name:   "not limited",
+			status: http.StatusOK,
+			header: http.Header{"X-Ratelimit-Remaining": {"0"}},
+		},
+		{
+			name:   "forbidden",
+			status: http.StatusForbidden,
+			header: http.Header{"X-Ratelimit-Remaining": {"4999"}},
+			body:   `{"message":"Resource not accessible by integration"}`,
+		},
+		{
+			name:        "retry after",
+			status:      http.StatusForbidden,
+			header:      http.Header{"Retry-After": {"30"}},
+			wantWait:    30 * time.Second,
+			wantLimited: true,
+		},
+		{
+			name:        "reset in the past",
+			status:      http.StatusForbidden,
+			header:      http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"1659355200"}},
+			wantLimited: true,
+		},
+		{
+			name:        "secondary rate limit without retry after",
+			status:      http.StatusForbidden,
+			body:        `{"message":"You have exceeded a secondary rate limit. Please wait a few minutes before you try again."}`,
+			wantWait:    defaultSecondaryRateLimitWait,
+			wantLimited: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: test.status,
+				Header:     test.header,
+				Body:       io.NopCloser(strings.NewReader(test.body)),
+			}
+			wait, limited := rateLimitWait(resp)
+			assert.Equal(t, test.wantWait, wait)
+			assert.Equal(t, test.wantLimited, limited)
+
+			// The body is still readable.
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.body, string(body))
+		})
+	}
+}
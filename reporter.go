@@ -0,0 +1,317 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+	"github.com/pkg/errors"
+
+	"github.com/codenotify/codenotify.run/internal/codenotify"
+	"github.com/codenotify/codenotify.run/internal/conf"
+	"github.com/codenotify/codenotify.run/internal/repoconf"
+)
+
+const (
+	// statusName is the name of the check run and the context of the commit
+	// status.
+	statusName = "Codenotify.run"
+	// rerunActionIdentifier is the identifier of the "Re-run" action of the
+	// check run.
+	rerunActionIdentifier = "rerun"
+)
+
+// runState is the final state of a run.
+type runState string
+
+const (
+	runStateSuccess    runState = "success"
+	runStateError      runState = "error"
+	runStateSuperseded runState = "superseded"
+	// runStateRequeued means the run was rate limited by GitHub, thus queued to
+	// run again after the rate limits reset.
+	runStateRequeued runState = "requeued"
+	// runStateInvalidConfig means the per-repository configuration file is
+	// invalid, thus Codenotify did not run.
+	runStateInvalidConfig runState = "invalid_config"
+)
+
+// runOutcome is the final outcome of a run to be reported.
+type runOutcome struct {
+	State    runState
+	Duration time.Duration
+	// LogURL is the URL of the run log, it may be empty when the run failed
+	// before the log is created.
+	LogURL string
+	// Report is the report of Codenotify, only available when the run succeeded.
+	Report *codenotify.Report
+	// InvalidConfig is the validation error of the per-repository configuration
+	// file, only available when the state is runStateInvalidConfig.
+	InvalidConfig *repoconf.ValidationError
+	// SupersededBySameHead indicates whether the run has been superseded by a
+	// newer run of the same head commit, e.g. a rerun, only available when the
+	// state is runStateSuperseded.
+	SupersededBySameHead bool
+}
+
+// description returns the one-line description of the outcome.
+func (o *runOutcome) description() string {
+	var description string
+	switch o.State {
+	case runStateSuccess:
+		description = "Codenotify ran successfully"
+	case runStateSuperseded:
+		description = "Superseded by a newer run"
+	case runStateInvalidConfig:
+		description = "Invalid configuration file " + repoconf.Path
+	case runStateRequeued:
+		return fmt.Sprintf("Rate limited by GitHub after %s, will run again", o.Duration.Truncate(time.Millisecond))
+	default:
+		description = "Something went wrong"
+	}
+	return fmt.Sprintf("%s in %s", description, o.Duration.Truncate(time.Millisecond))
+}
+
+// statusReporter reports the progress and the outcome of a run on the head
+// commit of the pull request.
+type statusReporter interface {
+	// Start reports that the run has started, the log URL may be empty when the
+	// run is not going to have a log.
+	Start(ctx context.Context, logURL string) error
+	// Complete reports the outcome of the run.
+	Complete(ctx context.Context, outcome *runOutcome) error
+}
+
+// newStatusReporter returns the status reporter for the pull request according
+// to the configuration of the GitHub App.
+func newStatusReporter(app *githubApp, client *github.Client, payload *github.PullRequestEvent) statusReporter {
+	if app.Reporter == conf.ReporterStatuses {
+		return &commitStatusReporter{
+			client:  client,
+			payload: payload,
+		}
+	}
+	return &checkRunReporter{
+		client:  client,
+		payload: payload,
+	}
+}
+
+// commitStatusReporter reports the run with a commit status.
+type commitStatusReporter struct {
+	client  *github.Client
+	payload *github.PullRequestEvent
+}
+
+func (r *commitStatusReporter) createStatus(ctx context.Context, state, description string, targetURL *string) error {
+	_, _, err := r.client.Repositories.CreateStatus(
+		ctx,
+		*r.payload.Repo.Owner.Login,
+		*r.payload.Repo.Name,
+		*r.payload.PullRequest.Head.SHA,
+		&github.RepoStatus{
+			State:       github.String(state),
+			TargetURL:   targetURL,
+			Description: github.String(description),
+			Context:     github.String(statusName),
+		},
+	)
+	return err
+}
+
+func (r *commitStatusReporter) Start(ctx context.Context, logURL string) error {
+	var targetURL *string
+	if logURL != "" {
+		targetURL = github.String(logURL)
+	}
+	return r.createStatus(ctx, "pending", "Running Codenotify", targetURL)
+}
+
+func (r *commitStatusReporter) Complete(ctx context.Context, outcome *runOutcome) error {
+	// NOTE: The newer run of the same head commit reports to the same commit
+	// status, which must not be overwritten.
+	if outcome.State == runStateSuperseded && outcome.SupersededBySameHead {
+		return nil
+	}
+
+	state := "error"
+	switch outcome.State {
+	case runStateSuccess, runStateSuperseded:
+		state = "success"
+	case runStateInvalidConfig:
+		state = "failure"
+	case runStateRequeued:
+		state = "pending"
+	}
+
+	var targetURL *string
+	if outcome.LogURL != "" {
+		targetURL = github.String(outcome.LogURL)
+	}
+	return r.createStatus(ctx, state, outcome.description(), targetURL)
+}
+
+// checkRunReporter reports the run with a check run, which comes with a summary
+// of the report and a "Re-run" action.
+type checkRunReporter struct {
+	client     *github.Client
+	payload    *github.PullRequestEvent
+	checkRunID int64
+}
+
+func (r *checkRunReporter) Start(ctx context.Context, logURL string) error {
+	opts := github.CreateCheckRunOptions{
+		Name:       statusName,
+		HeadSHA:    *r.payload.PullRequest.Head.SHA,
+		ExternalID: github.String(strconv.Itoa(*r.payload.PullRequest.Number)),
+		Status:     github.String("in_progress"),
+		StartedAt:  &github.Timestamp{Time: time.Now()},
+		Output: &github.CheckRunOutput{
+			Title:   github.String("Running Codenotify"),
+			Summary: github.String("Codenotify is running on this pull request."),
+		},
+	}
+	if logURL != "" {
+		opts.DetailsURL = github.String(logURL)
+		opts.Output.Text = github.String(fmt.Sprintf("Follow the [run log](%s) for progress.", logURL))
+	}
+
+	checkRun, _, err := r.client.Checks.CreateCheckRun(
+		ctx,
+		*r.payload.Repo.Owner.Login,
+		*r.payload.Repo.Name,
+		opts,
+	)
+	if err != nil {
+		return errors.Wrap(err, "create check run")
+	}
+	r.checkRunID = checkRun.GetID()
+	return nil
+}
+
+func (r *checkRunReporter) Complete(ctx context.Context, outcome *runOutcome) error {
+	if r.checkRunID == 0 {
+		return errors.New("check run has not been created")
+	}
+
+	conclusion := "failure"
+	switch outcome.State {
+	case runStateSuccess:
+		conclusion = "success"
+	case runStateSuperseded, runStateRequeued:
+		conclusion = "neutral"
+	}
+
+	opts := github.UpdateCheckRunOptions{
+		Name:        statusName,
+		Status:      github.String("completed"),
+		Conclusion:  github.String(conclusion),
+		CompletedAt: &github.Timestamp{Time: time.Now()},
+		Output: &github.CheckRunOutput{
+			Title:   github.String(outcome.description()),
+			Summary: github.String(checkRunSummary(outcome)),
+		},
+		Actions: []*github.CheckRunAction{
+			{
+				Label:       "Re-run",
+				Description: "Run Codenotify again",
+				Identifier:  rerunActionIdentifier,
+			},
+		},
+	}
+	if outcome.LogURL != "" {
+		opts.DetailsURL = github.String(outcome.LogURL)
+		opts.Output.Text = github.String(fmt.Sprintf("See the [run log](%s) for details.", outcome.LogURL))
+	}
+
+	_, _, err := r.client.Checks.UpdateCheckRun(
+		ctx,
+		*r.payload.Repo.Owner.Login,
+		*r.payload.Repo.Name,
+		r.checkRunID,
+		opts,
+	)
+	if err != nil {
+		return errors.Wrap(err, "update check run")
+	}
+	return nil
+}
+
+// checkRunSummary returns the Markdown summary of the check run for the
+// outcome.
+func checkRunSummary(outcome *runOutcome) string {
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "%s.\n\n", outcome.description())
+	if outcome.State == runStateInvalidConfig && outcome.InvalidConfig != nil {
+		_, _ = fmt.Fprintf(&b, "Please fix the following problems of `%s` in the base branch:\n\n", repoconf.Path)
+		for _, problem := range outcome.InvalidConfig.Problems {
+			_, _ = fmt.Fprintf(&b, "- %s\n", problem)
+		}
+		return b.String()
+	} else if outcome.State != runStateSuccess || outcome.Report == nil {
+		return b.String()
+	}
+
+	report := outcome.Report
+	if len(report.ModifiedRuleFiles) > 0 {
+		_, _ = fmt.Fprintf(&b, "> **Note**\n> This pull request modifies %s files: `%s`.\n\n", report.Filename, strings.Join(report.ModifiedRuleFiles, "`, `"))
+	}
+	if report.ThresholdExceeded {
+		_, _ = fmt.Fprintf(&b, "Nobody is notified because the number of subscribers has exceeded the threshold (%d).\n", report.SubscriberThreshold)
+		return b.String()
+	}
+
+	notifications := report.Notifications()
+	if len(notifications) == 0 {
+		_, _ = fmt.Fprintf(&b, "No subscribers are notified for %d changed file(s).\n", len(report.ChangedFiles))
+		return b.String()
+	}
+
+	subscribers := make([]string, 0, len(notifications))
+	for subscriber := range notifications {
+		subscribers = append(subscribers, subscriber)
+	}
+	sort.Strings(subscribers)
+	files := make([]string, 0, len(report.Subscribers))
+	for file := range report.Subscribers {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	_, _ = fmt.Fprintf(&b, "**Notified (%d):** %s\n\n", len(subscribers), strings.Join(subscribers, ", "))
+	_, _ = fmt.Fprintf(&b, "**Files matched (%d of %d changed):**\n\n", len(files), len(report.ChangedFiles))
+	for _, file := range files {
+		_, _ = fmt.Fprintf(&b, "- `%s`: %s\n", file, strings.Join(report.Subscribers[file], ", "))
+	}
+
+	if len(report.MatchedRules) > 0 {
+		_, _ = fmt.Fprintf(&b, "\n**Rules matched (%d):**\n\n", len(report.MatchedRules))
+		for _, rule := range report.MatchedRules {
+			_, _ = fmt.Fprintf(&b, "- `%s`: `%s` %s\n", rule.Location(), rule.Pattern, strings.Join(rule.Subscribers, " "))
+		}
+	} else if report.RulesUnavailable {
+		_, _ = fmt.Fprint(&b, "\nMatched rules are not available because Codenotify runs via its binary on this server.\n")
+	}
+	return b.String()
+}
+
+// isCheckRunRerunRequested returns true if the check run event asks for running
+// Codenotify again, either via the "Re-run" link of GitHub or the "Re-run"
+// action of the check run.
+func isCheckRunRerunRequested(payload *github.CheckRunEvent) bool {
+	switch payload.GetAction() {
+	case "rerequested":
+		return true
+	case "requested_action":
+		return payload.RequestedAction != nil && payload.RequestedAction.Identifier == rerunActionIdentifier
+	}
+	return false
+}
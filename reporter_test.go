@@ -0,0 +1,98 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/codenotify/codenotify.run/internal/codenotify"
+	"github.com/codenotify/codenotify.run/internal/repoconf"
+)
+
+func TestCheckRunSummary(t *testing.T) {
+	t.Run("no notifications", func(t *testing.T) {
+		got := checkRunSummary(&runOutcome{
+			State:    runStateSuccess,
+			Duration: 1500 * time.Millisecond,
+			Report: &codenotify.Report{
+				ChangedFiles: []string{"main.go"},
+				Subscribers:  map[string][]string{},
+			},
+		})
+		assert.Equal(t, "Codenotify ran successfully in 1.5s.\n\nNo subscribers are notified for 1 changed file(s).\n", got)
+	})
+
+	t.Run("notifications", func(t *testing.T) {
+		got := checkRunSummary(&runOutcome{
+			State:    runStateSuccess,
+			Duration: 1500 * time.Millisecond,
+			Report: &codenotify.Report{
+				ChangedFiles: []string{"internal/conf/conf.go", "main.go", "README.md"},
+				MatchedRules: []*codenotify.Rule{
+					{
+						Source:      "CODENOTIFY",
+						Line:        1,
+						Pattern:     "**/*.go",
+						Subscribers: []string{"@alice"},
+						Files:       []string{"internal/conf/conf.go", "main.go"},
+					},
+					{
+						Source:      "internal/CODENOTIFY",
+						Line:        2,
+						Pattern:     "conf/**",
+						Subscribers: []string{"@codenotify/maintainers"},
+						Files:       []string{"internal/conf/conf.go"},
+					},
+				},
+				Subscribers: map[string][]string{
+					"main.go":               {"@alice"},
+					"internal/conf/conf.go": {"@alice", "@codenotify/maintainers"},
+				},
+			},
+		})
+		want := "Codenotify ran successfully in 1.5s.\n\n" +
+			"**Notified (2):** @alice, @codenotify/maintainers\n\n" +
+			"**Files matched (2 of 3 changed):**\n\n" +
+			"- `internal/conf/conf.go`: @alice, @codenotify/maintainers\n" +
+			"- `main.go`: @alice\n" +
+			"\n**Rules matched (2):**\n\n" +
+			"- `CODENOTIFY:1`: `**/*.go` @alice\n" +
+			"- `internal/CODENOTIFY:2`: `conf/**` @codenotify/maintainers\n"
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		got := checkRunSummary(&runOutcome{
+			State:    runStateInvalidConfig,
+			Duration: 1500 * time.Millisecond,
+			InvalidConfig: &repoconf.ValidationError{
+				Problems: []string{`"filename" must not be empty`},
+			},
+		})
+		want := "Invalid configuration file .github/codenotify.yml in 1.5s.\n\n" +
+			"Please fix the following problems of `.github/codenotify.yml` in the base branch:\n\n" +
+			"- \"filename\" must not be empty\n"
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		got := checkRunSummary(&runOutcome{
+			State:    runStateError,
+			Duration: 1500 * time.Millisecond,
+		})
+		assert.Equal(t, "Something went wrong in 1.5s.\n\n", got)
+	})
+}
+
+func TestCommitStatusReporter_Complete(t *testing.T) {
+	// The client is not used because nothing is reported.
+	r := &commitStatusReporter{}
+	err := r.Complete(context.Background(), &runOutcome{State: runStateSuperseded, SupersededBySameHead: true})
+	assert.NoError(t, err, "must not overwrite the commit status of the newer run")
+}
@@ -0,0 +1,294 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/flamego/flamego"
+	"github.com/flamego/session"
+	"github.com/oklog/ulid/v2"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/codenotify/codenotify.run/internal/conf"
+	"github.com/codenotify/codenotify.run/internal/rundb"
+	"github.com/codenotify/codenotify.run/internal/runlog"
+)
+
+// newRunStore returns the store of run logs according to the configuration.
+func newRunStore(config *conf.Config) (runlog.Store, error) {
+	if config.Server.LogsStorage == conf.LogsStorageS3 {
+		return runlog.NewS3Store(
+			runlog.S3Options{
+				Endpoint:        config.S3.Endpoint,
+				Region:          config.S3.Region,
+				Bucket:          config.S3.Bucket,
+				AccessKeyID:     config.S3.AccessKeyID,
+				SecretAccessKey: config.S3.SecretAccessKey,
+				UseSSL:          config.S3.UseSSL,
+				Prefix:          config.S3.Prefix,
+			},
+		)
+	}
+	return runlog.NewFileStore(filepath.Join(config.Server.LogsRootDir, "runs")), nil
+}
+
+// openRunDB opens the database of run history according to the configuration.
+func openRunDB(ctx context.Context, config *conf.Config) (*rundb.DB, error) {
+	if config.Database.Type == conf.DatabasePostgres {
+		return rundb.Open(ctx, rundb.TypePostgres, config.Database.DSN)
+	}
+	return rundb.Open(ctx, rundb.TypeSQLite, config.Database.Path)
+}
+
+// runLogURL returns the URL of the log of the run.
+func runLogURL(config *conf.Config, id ulid.ULID) string {
+	return fmt.Sprintf("%s/runs/%s", config.Server.ExternalURL, id)
+}
+
+// collectRunLogs deletes run logs that violate the retention policy at every
+// configured interval.
+func collectRunLogs(ctx context.Context, config *conf.Config, store runlog.Store) {
+	policy := runlog.RetentionPolicy{
+		MaxAge:               config.Retention.MaxAge,
+		MaxTotalSize:         config.Retention.MaxTotalSizeMB << 20,
+		MaxRunsPerRepository: config.Retention.MaxRunsPerRepository,
+	}
+	ticker := time.NewTicker(config.Retention.Interval)
+	defer ticker.Stop()
+	for {
+		result, err := runlog.Collect(ctx, store, policy, time.Now())
+		if result != nil {
+			var runs int
+			var bytes int64
+			for reason, reclaimed := range result.Reclaimed {
+				runs += reclaimed.Runs
+				bytes += reclaimed.Bytes
+				runLogsReclaimedTotal.WithLabelValues(reason).Add(float64(reclaimed.Runs))
+				runLogsReclaimedBytesTotal.WithLabelValues(reason).Add(float64(reclaimed.Bytes))
+			}
+			if err == nil {
+				runLogsRetained.Set(float64(result.Runs))
+				runLogsRetainedBytes.Set(float64(result.Bytes))
+			}
+			if runs > 0 {
+				log.Info("Reclaimed %d run logs (%d bytes)", runs, bytes)
+			}
+		}
+		if err != nil {
+			log.Error("Failed to collect run logs: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleRunLog returns the handler that serves the run, which is a page with
+// details of the run by default, the metadata with "?format=json", the raw log
+// with "?format=raw", or the log tailed as Server-Sent Events when requested
+// with "Accept: text/event-stream". Runs of private repositories are only
+// served to logged in users who have read access to the repository, which
+// requires the GitHub OAuth of the GitHub App of the run to be enabled.
+func handleRunLog(store runlog.Store, apps githubApps, checkAccess repoAccessChecker) flamego.Handler {
+	return func(c flamego.Context, sess session.Session) (int, []byte) {
+		id, err := runlog.ParseID(c.Param("runID"))
+		if err != nil {
+			return http.StatusBadRequest, []byte("Invalid run ID")
+		}
+
+		// NOTE: Logs without metadata predate the access control, their visibility
+		// is unknown thus are treated as not existing.
+		ctx := c.Request().Context()
+		meta, err := store.Metadata(ctx, id)
+		if err == runlog.ErrNotExist {
+			return http.StatusNotFound, []byte("The run log no longer exists")
+		} else if err != nil {
+			log.Error("Failed to get metadata of run %s: %v", id, err)
+			return http.StatusInternalServerError, []byte("Failed to get run log")
+		}
+
+		// Admins can view every run log, e.g. those linked from the dashboard.
+		// Others are checked with the GitHub App of the run, because GitHub Apps
+		// may be on different GitHub hosts.
+		if meta.Private && !isAdmin(sess) {
+			app := apps.get(meta.App)
+			if app == nil || app.oauth == nil {
+				return http.StatusForbidden, []byte("Run logs of private repositories are not available because GitHub OAuth is not configured")
+			}
+
+			token, _ := sess.Get(oauthTokenKey(app)).(string)
+			if token == "" {
+				c.Redirect(loginURL(app, c.Request().URL.Path))
+				return http.StatusFound, nil
+			}
+
+			ok, err := checkAccess(ctx, app, token, meta)
+			if err == errBadOAuthToken {
+				sess.Delete(oauthTokenKey(app))
+				c.Redirect(loginURL(app, c.Request().URL.Path))
+				return http.StatusFound, nil
+			} else if err != nil {
+				log.Error("Failed to check access to repository %q: %v", meta.Repository, err)
+				return http.StatusInternalServerError, []byte("Failed to check access to the repository")
+			} else if !ok {
+				// Do not reveal the existence of the run to people without access.
+				return http.StatusNotFound, []byte("The run log no longer exists")
+			}
+		}
+
+		if strings.Contains(c.Request().Header.Get("Accept"), "text/event-stream") {
+			tailRunLog(c, store, id)
+			return http.StatusOK, nil
+		}
+
+		format := c.Query("format")
+		if format == "json" {
+			data, err := json.Marshal(
+				struct {
+					ID string `json:"id"`
+					*runlog.Metadata
+				}{
+					ID:       id.String(),
+					Metadata: meta,
+				},
+			)
+			if err != nil {
+				log.Error("Failed to encode metadata of run %s: %v", id, err)
+				return http.StatusInternalServerError, []byte("Failed to encode run")
+			}
+			c.ResponseWriter().Header().Set("Content-Type", "application/json; charset=utf-8")
+			return http.StatusOK, data
+		}
+
+		// NOTE: The log of a run in progress is tailed by the page instead.
+		var data []byte
+		if format == "raw" || !meta.InProgress {
+			data, err = store.Get(ctx, id)
+			if err == runlog.ErrNotExist {
+				return http.StatusNotFound, []byte("The run log no longer exists")
+			} else if err != nil {
+				log.Error("Failed to get run log %s: %v", id, err)
+				return http.StatusInternalServerError, []byte("Failed to get run log")
+			}
+		}
+
+		if format == "raw" {
+			// NOTE: Logs may contain arbitrary output, never let browsers sniff it as
+			// other content types (e.g. HTML).
+			c.ResponseWriter().Header().Set("Content-Type", "text/plain; charset=utf-8")
+			c.ResponseWriter().Header().Set("X-Content-Type-Options", "nosniff")
+			return http.StatusOK, data
+		}
+
+		return renderTemplate(c, http.StatusOK, "run.html",
+			map[string]any{
+				"ID":   id.String(),
+				"Meta": meta,
+				"Log":  string(data),
+			},
+		)
+	}
+}
+
+const (
+	// runLogTailInterval is the interval to check for new output of a run in
+	// progress.
+	runLogTailInterval = time.Second
+	// maxRunLogTailDuration is the maximum duration of a single stream, clients
+	// reconnect and resume from where they left off afterwards.
+	maxRunLogTailDuration = 30 * time.Minute
+)
+
+// tailRunLog streams the log of the run as Server-Sent Events until the run
+// finishes. Every "log" event carries a JSON-encoded chunk of the log and its ID
+// is the offset of the log after the chunk, which is sent back by clients as
+// the "Last-Event-ID" header to resume upon reconnecting. A "done" event is
+// sent once the run has finished.
+func tailRunLog(c flamego.Context, store runlog.Store, id ulid.ULID) {
+	w := c.ResponseWriter()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Disable response buffering of reverse proxies like Nginx.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	offset, _ := strconv.Atoi(c.Request().Header.Get("Last-Event-ID"))
+	ctx := c.Request().Context()
+	ticker := time.NewTicker(runLogTailInterval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(maxRunLogTailDuration)
+	defer deadline.Stop()
+	for {
+		// NOTE: The metadata must be read before the log, the log is complete when
+		// the metadata tells the run has finished.
+		meta, err := store.Metadata(ctx, id)
+		if err != nil {
+			if err != runlog.ErrNotExist && ctx.Err() == nil {
+				log.Error("Failed to get metadata of run %s: %v", id, err)
+			}
+			return
+		}
+		data, err := store.Get(ctx, id)
+		if err != nil {
+			if err != runlog.ErrNotExist && ctx.Err() == nil {
+				log.Error("Failed to get run log %s: %v", id, err)
+			}
+			return
+		}
+
+		end := len(data)
+		if meta.InProgress {
+			end = completeRunes(data)
+		}
+		if offset < 0 || offset > end {
+			offset = 0 // The log is not the one the client has seen
+		}
+		if end > offset {
+			chunk, _ := json.Marshal(string(data[offset:end]))
+			_, _ = fmt.Fprintf(w, "id: %d\nevent: log\ndata: %s\n\n", end, chunk)
+			offset = end
+		}
+		if !meta.InProgress {
+			_, _ = fmt.Fprint(w, "event: done\ndata: {}\n\n")
+			w.Flush()
+			return
+		}
+		w.Flush()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline.C:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// completeRunes returns the length of the data without the incomplete UTF-8
+// encoded rune at the end if any.
+func completeRunes(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(data)
+}
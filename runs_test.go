@@ -0,0 +1,433 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flamego/flamego"
+	"github.com/flamego/session"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/codenotify/codenotify.run/internal/codenotify"
+	"github.com/codenotify/codenotify.run/internal/conf"
+	"github.com/codenotify/codenotify.run/internal/runlog"
+)
+
+func TestHandleRunLog(t *testing.T) {
+	rootDir := t.TempDir()
+	store := runlog.NewFileStore(filepath.Join(rootDir, "runs"))
+
+	id := runlog.NewID()
+	require.NoError(t, store.Put(context.Background(), id, &runlog.Metadata{Repository: "codenotify/codenotify.run"}, []byte("<html>git fetch</html>")))
+	// A file outside of the store that should never be served.
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "secret.log"), []byte("secret"), 0600))
+
+	f := flamego.New()
+	f.Get("/runs/{runID}", session.Sessioner(), handleRunLog(store, nil, nil))
+
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "raw",
+			path:     "/runs/" + id.String() + "?format=raw",
+			wantCode: http.StatusOK,
+			wantBody: "<html>git fetch</html>",
+		},
+		{
+			name:     "not found",
+			path:     "/runs/" + runlog.NewID().String(),
+			wantCode: http.StatusNotFound,
+			wantBody: "The run log no longer exists",
+		},
+		{
+			name:     "malformed",
+			path:     "/runs/not-a-ulid",
+			wantCode: http.StatusBadRequest,
+			wantBody: "Invalid run ID",
+		},
+		{
+			name:     "lowercase",
+			path:     "/runs/" + strings.ToLower(id.String()),
+			wantCode: http.StatusBadRequest,
+			wantBody: "Invalid run ID",
+		},
+		{
+			name:     "encoded traversal",
+			path:     "/runs/..%2Fsecret",
+			wantCode: http.StatusNotFound, // Not routed to the handler at all
+			wantBody: "404 page not found\n",
+		},
+		{
+			name:     "double encoded traversal",
+			path:     "/runs/..%252Fsecret",
+			wantCode: http.StatusBadRequest,
+			wantBody: "Invalid run ID",
+		},
+		{
+			name:     "dot",
+			path:     "/runs/..",
+			wantCode: http.StatusBadRequest,
+			wantBody: "Invalid run ID",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, test.path, nil)
+			require.NoError(t, err)
+
+			f.ServeHTTP(resp, req)
+			assert.Equal(t, test.wantCode, resp.Code)
+			assert.Equal(t, test.wantBody, resp.Body.String())
+			assert.NotContains(t, resp.Body.String(), "secret")
+		})
+	}
+
+	t.Run("without metadata", func(t *testing.T) {
+		id := runlog.NewID()
+		require.NoError(t, os.WriteFile(filepath.Join(rootDir, "runs", id.String()+".log"), []byte("git fetch"), 0600))
+
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/runs/"+id.String(), nil)
+		require.NoError(t, err)
+
+		f.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+
+	t.Run("content type", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/runs/"+id.String()+"?format=raw", nil)
+		require.NoError(t, err)
+
+		f.ServeHTTP(resp, req)
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header().Get("Content-Type"))
+		assert.Equal(t, "nosniff", resp.Header().Get("X-Content-Type-Options"))
+	})
+
+	t.Run("page", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/runs/"+id.String(), nil)
+		require.NoError(t, err)
+
+		f.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+		assert.Contains(t, resp.Body.String(), "codenotify/codenotify.run")
+		// The log must be escaped.
+		assert.Contains(t, resp.Body.String(), "&lt;html&gt;git fetch&lt;/html&gt;")
+		assert.NotContains(t, resp.Body.String(), "<html>git fetch</html>")
+	})
+}
+
+func TestHandleRunLog_Details(t *testing.T) {
+	store := runlog.NewFileStore(t.TempDir())
+	id := runlog.NewID()
+	startedAt := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	meta := &runlog.Metadata{
+		Repository:     "codenotify/codenotify.run",
+		RepositoryURL:  "https://github.com/codenotify/codenotify.run",
+		PullRequest:    1,
+		PullRequestURL: "https://github.com/codenotify/codenotify.run/pull/1",
+		BaseSHA:        "1111111111111111111111111111111111111111",
+		HeadSHA:        "2222222222222222222222222222222222222222",
+		Trigger:        "pull_request.opened",
+		StartedAt:      startedAt,
+		CompletedAt:    startedAt.Add(3 * time.Second),
+		Phases: []runlog.Phase{
+			{Name: "clone", StartedAt: startedAt, CompletedAt: startedAt.Add(time.Second)},
+			{Name: "codenotify", StartedAt: startedAt.Add(time.Second), CompletedAt: startedAt.Add(1500 * time.Millisecond)},
+		},
+		State: "success",
+		Report: &codenotify.Report{
+			Filename:     "CODENOTIFY",
+			ChangedFiles: []string{"main.go"},
+			MatchedRules: []*codenotify.Rule{
+				{Source: "CODENOTIFY", Line: 1, Pattern: "*.go", Subscribers: []string{"@alice"}, Files: []string{"main.go"}},
+			},
+			Subscribers: map[string][]string{"main.go": {"@alice"}},
+		},
+	}
+	require.NoError(t, store.Put(context.Background(), id, meta, []byte("git fetch")))
+
+	f := flamego.New()
+	f.Get("/runs/{runID}", session.Sessioner(), handleRunLog(store, nil, nil))
+
+	t.Run("page", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/runs/"+id.String(), nil)
+		require.NoError(t, err)
+
+		f.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		body := resp.Body.String()
+		for _, want := range []string{
+			`<a href="https://github.com/codenotify/codenotify.run/pull/1">#1</a>`,
+			meta.BaseSHA,
+			meta.HeadSHA,
+			"pull_request.opened",
+			`<strong class="state-success">success</strong> in 3s`,
+			"<tr><th>clone</th><td>1s</td></tr>",
+			"<tr><th>codenotify</th><td>500ms</td></tr>",
+			"<tr><td><code>main.go</code></td><td>@alice</td></tr>",
+			"<code>CODENOTIFY:1</code>: <code>*.go</code> @alice",
+			`<pre id="log">git fetch</pre>`,
+		} {
+			assert.Contains(t, body, want)
+		}
+		assert.NotContains(t, body, "EventSource")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodGet, "/runs/"+id.String()+"?format=json", nil)
+		require.NoError(t, err)
+
+		f.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"))
+
+		var got struct {
+			ID string `json:"id"`
+			runlog.Metadata
+		}
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &got))
+		assert.Equal(t, id.String(), got.ID)
+		assert.Equal(t, *meta, got.Metadata)
+	})
+}
+
+func TestHandleRunLog_Private(t *testing.T) {
+	store := runlog.NewFileStore(t.TempDir())
+	id := runlog.NewID()
+	require.NoError(t, store.Put(context.Background(), id, &runlog.Metadata{Repository: "codenotify/private", RepositoryID: 1, Private: true}, []byte("git fetch")))
+	// The run of another GitHub App, e.g. on GitHub Enterprise Server.
+	internalID := runlog.NewID()
+	require.NoError(t, store.Put(context.Background(), internalID, &runlog.Metadata{Repository: "codenotify/internal", RepositoryID: 2, Private: true, App: "internal"}, []byte("git fetch")))
+
+	checkAccess := func(_ context.Context, app *githubApp, token string, meta *runlog.Metadata) (bool, error) {
+		assert.Equal(t, int64(1), meta.RepositoryID)
+		assert.Equal(t, conf.DefaultGitHubApp, app.Name, "checked with the GitHub App of the run")
+		switch token {
+		case "reader":
+			return true, nil
+		case "expired":
+			return false, errBadOAuthToken
+		}
+		return false, nil
+	}
+	newServer := func(oauthEnabled bool) *flamego.Flame {
+		apps := githubApps{
+			{GitHubApp: &conf.GitHubApp{Name: conf.DefaultGitHubApp}},
+			{GitHubApp: &conf.GitHubApp{Name: "internal", APIURL: "https://github.example.com/api/v3/"}},
+		}
+		if oauthEnabled {
+			apps[0].oauth = &oauth2.Config{ClientID: "client-id"}
+		}
+
+		f := flamego.New()
+		f.Get("/runs/{runID}",
+			session.Sessioner(),
+			// Pretend the user has logged in with the default app with the token in
+			// the header.
+			func(r *http.Request, sess session.Session) {
+				if token := r.Header.Get("Token"); token != "" {
+					sess.Set(oauthTokenKey(apps[0]), token)
+				}
+				if r.Header.Get("Admin") != "" {
+					sess.Set(sessionKeyAdmin, true)
+				}
+			},
+			handleRunLog(store, apps, checkAccess),
+		)
+		return f
+	}
+
+	tests := []struct {
+		name         string
+		id           ulid.ULID
+		oauthEnabled bool
+		token        string
+		admin        bool
+		wantCode     int
+		wantLocation string
+		wantBody     string
+	}{
+		{
+			name:         "OAuth not configured",
+			id:           id,
+			oauthEnabled: false,
+			token:        "reader",
+			wantCode:     http.StatusForbidden,
+			wantBody:     "Run logs of private repositories are not available because GitHub OAuth is not configured",
+		},
+		{
+			name:         "OAuth not configured for the app of the run",
+			id:           internalID,
+			oauthEnabled: true,
+			token:        "reader",
+			wantCode:     http.StatusForbidden,
+			wantBody:     "Run logs of private repositories are not available because GitHub OAuth is not configured",
+		},
+		{
+			name:         "not logged in",
+			id:           id,
+			oauthEnabled: true,
+			wantCode:     http.StatusFound,
+			wantLocation: "/-/oauth/login?app=default&redirect_to=%2Fruns%2F" + id.String(),
+		},
+		{
+			name:         "expired token",
+			id:           id,
+			oauthEnabled: true,
+			token:        "expired",
+			wantCode:     http.StatusFound,
+			wantLocation: "/-/oauth/login?app=default&redirect_to=%2Fruns%2F" + id.String(),
+		},
+		{
+			name:         "no access",
+			id:           id,
+			oauthEnabled: true,
+			token:        "stranger",
+			wantCode:     http.StatusNotFound,
+			wantBody:     "The run log no longer exists",
+		},
+		{
+			name:         "has access",
+			id:           id,
+			oauthEnabled: true,
+			token:        "reader",
+			wantCode:     http.StatusOK,
+		},
+		{
+			name:         "admin",
+			id:           internalID,
+			oauthEnabled: false,
+			admin:        true,
+			wantCode:     http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodGet, "/runs/"+test.id.String(), nil)
+			require.NoError(t, err)
+			req.Header.Set("Token", test.token)
+			if test.admin {
+				req.Header.Set("Admin", "1")
+			}
+
+			newServer(test.oauthEnabled).ServeHTTP(resp, req)
+			assert.Equal(t, test.wantCode, resp.Code)
+			assert.Equal(t, test.wantLocation, resp.Header().Get("Location"))
+			if test.wantBody != "" {
+				assert.Equal(t, test.wantBody, resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleRunLog_Tail(t *testing.T) {
+	ctx := context.Background()
+	store := runlog.NewFileStore(t.TempDir())
+	id := runlog.NewID()
+	meta := &runlog.Metadata{
+		Repository: "codenotify/codenotify.run",
+		InProgress: true,
+	}
+	require.NoError(t, store.Put(ctx, id, meta, []byte("git clone\n")))
+
+	f := flamego.New()
+	f.Get("/runs/{runID}", session.Sessioner(), handleRunLog(store, nil, nil))
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	get := func(t *testing.T, accept, lastEventID string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/runs/"+id.String(), nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", accept)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("page", func(t *testing.T) {
+		resp := get(t, "text/html", "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "new EventSource")
+		assert.Contains(t, string(body), `<pre id="log"></pre>`, "log should be tailed")
+	})
+
+	resp := get(t, "text/event-stream", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		var event string
+		for {
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			if line == "\n" {
+				return event
+			}
+			event += line
+		}
+	}
+	assert.Equal(t, "id: 10\nevent: log\ndata: \"git clone\\n\"\n", readEvent())
+
+	meta.InProgress = false
+	require.NoError(t, store.Put(ctx, id, meta, []byte("git clone\ngit fetch\n")))
+	assert.Equal(t, "id: 20\nevent: log\ndata: \"git fetch\\n\"\n", readEvent())
+	assert.Equal(t, "event: done\ndata: {}\n", readEvent())
+	_, err := r.ReadByte()
+	assert.Equal(t, io.EOF, err, "stream should end after the run has finished")
+
+	t.Run("resume", func(t *testing.T) {
+		resp := get(t, "text/event-stream", "10")
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "id: 20\nevent: log\ndata: \"git fetch\\n\"\n\nevent: done\ndata: {}\n\n", string(body))
+	})
+
+	t.Run("finished page", func(t *testing.T) {
+		resp := get(t, "text/html", "")
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.NotContains(t, string(body), "EventSource")
+		assert.Contains(t, string(body), "git clone\ngit fetch\n")
+	})
+}
+
+func TestCompleteRunes(t *testing.T) {
+	assert.Equal(t, 3, completeRunes([]byte("abc")))
+	assert.Equal(t, 3, completeRunes([]byte("abc\xe4\xbd")))     // Incomplete "你"
+	assert.Equal(t, 6, completeRunes([]byte("abc\xe4\xbd\xa0"))) // Complete "你"
+	assert.Equal(t, 0, completeRunes(nil))
+}
@@ -0,0 +1,113 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/google/go-github/v45/github"
+	"github.com/pkg/errors"
+)
+
+// errSuperseded is the cancellation cause of a run that has been superseded by
+// a newer run of the same pull request.
+var errSuperseded = errors.New("superseded by a newer run")
+
+// pullRequestKey returns the key that identifies the pull request of the
+// payload across runs.
+func pullRequestKey(payload *github.PullRequestEvent) string {
+	return fmt.Sprintf("%s#%d", payload.GetRepo().GetFullName(), payload.GetPullRequest().GetNumber())
+}
+
+type inflightRun struct {
+	jobID   string
+	headSHA string
+	cancel  context.CancelCauseFunc
+}
+
+// runRegistry keeps track of the latest job and the in-flight run of each pull
+// request, so that a newer job cancels the older run of the same pull request.
+// Job IDs are ULIDs, thus comparing them lexicographically tells which one is
+// newer.
+type runRegistry struct {
+	mu       sync.Mutex
+	latest   map[string]string      // Pull request key -> latest job ID
+	inflight map[string]inflightRun // Pull request key -> in-flight run
+}
+
+func newRunRegistry() *runRegistry {
+	return &runRegistry{
+		latest:   make(map[string]string),
+		inflight: make(map[string]inflightRun),
+	}
+}
+
+// supersede records the job as the latest of the pull request and cancels the
+// in-flight run if it belongs to an older job.
+func (r *runRegistry) supersede(key, jobID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if jobID < r.latest[key] {
+		return
+	}
+	r.latest[key] = jobID
+
+	if run, ok := r.inflight[key]; ok && run.jobID < jobID {
+		run.cancel(errSuperseded)
+	}
+}
+
+// start registers the job as the in-flight run of the head commit of the pull
+// request and returns the context that is cancelled once the run is superseded,
+// along with the function to be called when the run is done. It returns false
+// if a newer job of the same pull request is already known, in which case the
+// job should be skipped.
+func (r *runRegistry) start(ctx context.Context, key, jobID, headSHA string) (context.Context, func(), bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if jobID < r.latest[key] {
+		return ctx, func() {}, false
+	}
+	r.latest[key] = jobID
+
+	if run, ok := r.inflight[key]; ok {
+		run.cancel(errSuperseded)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	r.inflight[key] = inflightRun{
+		jobID:   jobID,
+		headSHA: headSHA,
+		cancel:  cancel,
+	}
+	done := func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		cancel(nil)
+		if run, ok := r.inflight[key]; ok && run.jobID == jobID {
+			delete(r.inflight, key)
+		}
+		if r.latest[key] == jobID {
+			delete(r.latest, key)
+		}
+	}
+	return ctx, done, true
+}
+
+// supersededBySameHead returns true if the in-flight run of the pull request
+// belongs to a newer job of the same head commit, e.g. a rerun, which reports
+// its own progress on the same commit.
+func (r *runRegistry) supersededBySameHead(key, jobID, headSHA string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	run, ok := r.inflight[key]
+	return ok && run.jobID > jobID && run.headSHA == headSHA
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunRegistry(t *testing.T) {
+	const key = "codenotify/codenotify.run#1"
+
+	t.Run("newer job cancels in-flight run", func(t *testing.T) {
+		runs := newRunRegistry()
+		ctx, done, ok := runs.start(context.Background(), key, "01A", "head")
+		defer done()
+		assert.True(t, ok)
+
+		runs.supersede(key, "01B")
+		assert.ErrorIs(t, context.Cause(ctx), errSuperseded)
+	})
+
+	t.Run("older job is skipped", func(t *testing.T) {
+		runs := newRunRegistry()
+		runs.supersede(key, "01A")
+		runs.supersede(key, "01B")
+
+		_, done, ok := runs.start(context.Background(), key, "01A", "head")
+		done()
+		assert.False(t, ok)
+
+		ctx, done, ok := runs.start(context.Background(), key, "01B", "head")
+		defer done()
+		assert.True(t, ok)
+		assert.NoError(t, ctx.Err())
+	})
+
+	t.Run("other pull requests are not affected", func(t *testing.T) {
+		runs := newRunRegistry()
+		ctx, done, ok := runs.start(context.Background(), key, "01A", "head")
+		defer done()
+		assert.True(t, ok)
+
+		runs.supersede("codenotify/codenotify.run#2", "01B")
+		assert.NoError(t, ctx.Err())
+	})
+
+	t.Run("superseded by the same head commit", func(t *testing.T) {
+		runs := newRunRegistry()
+		_, done, ok := runs.start(context.Background(), key, "01A", "head")
+		defer done()
+		assert.True(t, ok)
+		assert.False(t, runs.supersededBySameHead(key, "01A", "head"), "not superseded yet")
+
+		_, done, ok = runs.start(context.Background(), key, "01B", "head")
+		defer done()
+		assert.True(t, ok)
+		assert.True(t, runs.supersededBySameHead(key, "01A", "head"))
+
+		_, done, ok = runs.start(context.Background(), key, "01C", "newer-head")
+		defer done()
+		assert.True(t, ok)
+		assert.False(t, runs.supersededBySameHead(key, "01B", "head"))
+	})
+}
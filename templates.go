@@ -0,0 +1,43 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/flamego/flamego"
+	log "unknwon.dev/clog/v2"
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+// templates contains all the HTML templates, which are named by their file
+// names, e.g. "run.html".
+var templates = template.Must(
+	template.New("").
+		Funcs(template.FuncMap{
+			"duration": func(d time.Duration) string {
+				return d.Truncate(time.Millisecond).String()
+			},
+		}).
+		ParseFS(templateFS, "templates/*.html"),
+)
+
+// renderTemplate renders the HTML template with the data as the response.
+func renderTemplate(c flamego.Context, status int, name string, data any) (int, []byte) {
+	var buf bytes.Buffer
+	err := templates.ExecuteTemplate(&buf, name, data)
+	if err != nil {
+		log.Error("Failed to render template %q: %v", name, err)
+		return http.StatusInternalServerError, []byte("Failed to render page")
+	}
+	c.ResponseWriter().Header().Set("Content-Type", "text/html; charset=utf-8")
+	return status, buf.Bytes()
+}
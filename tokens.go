@@ -0,0 +1,107 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// installationTokenRefreshBefore is how long before the expiry an installation
+// access token is refreshed, which leaves enough time for a run to finish with
+// the token, e.g. cloning the repository.
+const installationTokenRefreshBefore = 10 * time.Minute
+
+// installationTokenCreator creates a new access token of the installation, and
+// returns the token along with its expiry.
+type installationTokenCreator func(ctx context.Context, installationID int64) (token string, expiresAt time.Time, err error)
+
+// installationToken is a cached access token of an installation.
+type installationToken struct {
+	mu        sync.Mutex // Serializes creations of the token
+	token     string
+	expiresAt time.Time
+}
+
+// tokenCache caches access tokens of installations until shortly before they
+// expire. It is safe for concurrent use.
+type tokenCache struct {
+	create installationTokenCreator
+	now    func() time.Time
+
+	mu     sync.Mutex
+	tokens map[int64]*installationToken
+}
+
+// newTokenCache returns a new token cache that creates tokens with the given
+// function.
+func newTokenCache(create installationTokenCreator) *tokenCache {
+	return &tokenCache{
+		create: create,
+		now:    time.Now,
+		tokens: make(map[int64]*installationToken),
+	}
+}
+
+// Get returns a valid access token of the installation, which is created only
+// when there is no cached one or it is about to expire.
+func (c *tokenCache) Get(ctx context.Context, installationID int64) (string, error) {
+	c.mu.Lock()
+	t, ok := c.tokens[installationID]
+	if !ok {
+		t = &installationToken{}
+		c.tokens[installationID] = t
+	}
+	c.mu.Unlock()
+
+	// NOTE: Only lock the token of the installation so that workers of other
+	// installations are not blocked while creating the token, and concurrent
+	// workers of the same installation reuse the token created by the first one.
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && c.now().Add(installationTokenRefreshBefore).Before(t.expiresAt) {
+		return t.token, nil
+	}
+
+	token, expiresAt, err := c.create(ctx, installationID)
+	if err != nil {
+		return "", err
+	}
+	t.token = token
+	t.expiresAt = expiresAt
+	return token, nil
+}
+
+// Invalidate removes the cached access token of the installation, e.g. when the
+// installation is deleted or suspended.
+func (c *tokenCache) Invalidate(installationID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tokens, installationID)
+}
+
+// createInstallationToken returns the function that creates access tokens of
+// installations of the GitHub App.
+func createInstallationToken(app *githubApp) installationTokenCreator {
+	return func(ctx context.Context, installationID int64) (string, time.Time, error) {
+		client, err := newAppClient(app)
+		if err != nil {
+			return "", time.Time{}, errors.Wrap(err, "new app client")
+		}
+
+		token, _, err := client.Apps.CreateInstallationToken(ctx, installationID, nil)
+		if err != nil {
+			return "", time.Time{}, errors.Wrap(err, "create installation access token")
+		}
+		if token.GetToken() == "" {
+			return "", time.Time{}, errors.New("empty token returned")
+		}
+		return token.GetToken(), token.GetExpiresAt(), nil
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	var created atomic.Int32
+	var fail atomic.Bool
+	tokens := newTokenCache(func(_ context.Context, installationID int64) (string, time.Time, error) {
+		if fail.Load() {
+			return "", time.Time{}, errors.New("boom")
+		}
+		n := created.Add(1)
+		return fmt.Sprintf("token-%d-%d", installationID, n), now.Add(time.Hour), nil
+	})
+	tokens.now = func() time.Time { return now }
+
+	// Concurrent workers of the same installation share a single token.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := tokens.Get(ctx, 1)
+			assert.NoError(t, err)
+			assert.Equal(t, "token-1-1", token)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), created.Load())
+
+	// Tokens are cached per installation.
+	token, err := tokens.Get(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "token-2-2", token)
+
+	// Invalidation only affects the given installation.
+	tokens.Invalidate(2)
+	token, err = tokens.Get(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "token-1-1", token)
+	token, err = tokens.Get(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "token-2-3", token)
+
+	// The token is refreshed shortly before it expires.
+	now = now.Add(49 * time.Minute)
+	token, err = tokens.Get(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "token-1-1", token)
+	now = now.Add(time.Minute)
+	token, err = tokens.Get(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "token-1-4", token)
+
+	// Failures are not cached.
+	tokens.Invalidate(1)
+	fail.Store(true)
+	_, err = tokens.Get(ctx, 1)
+	assert.Error(t, err)
+	fail.Store(false)
+	token, err = tokens.Get(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "token-1-5", token)
+}
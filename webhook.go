@@ -0,0 +1,184 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/google/go-github/v45/github"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/codenotify/codenotify.run/internal/queue"
+)
+
+// handleWebhook returns the handler that validates incoming GitHub webhook
+// events of the GitHub Apps and enqueues the ones that need to be processed.
+func handleWebhook(apps githubApps, q *queue.Queue, runs *runRegistry) func(r *http.Request) (int, string) {
+	return func(r *http.Request) (int, string) {
+		app := apps.forWebhook(r)
+		event := r.Header.Get("X-GitHub-Event")
+		deliveryID := r.Header.Get("X-GitHub-Delivery")
+		log.Trace("Received event %q with delivery %q for GitHub App %q", event, deliveryID, app.Name)
+
+		switch event {
+		case "installation", "pull_request", "check_run", "check_suite", "issue_comment":
+		default:
+			return http.StatusOK, fmt.Sprintf("Event %q has been received but nothing to do", event)
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return http.StatusInternalServerError, fmt.Sprintf("Failed to read request body: %v", err)
+		}
+
+		if app.WebhookSecret != "" {
+			ok, err := validateGitHubWebhookSignature256(r.Header.Get("X-Hub-Signature-256"), app.WebhookSecret, body)
+			if err != nil {
+				return http.StatusInternalServerError, fmt.Sprintf("Failed to validate signature: %v", err)
+			} else if !ok {
+				return http.StatusBadRequest, `Mismatched payload signature for "X-Hub-Signature-256"`
+			}
+		}
+
+		enqueue := func(installationID int64) (*queue.Job, int, string) {
+			job, err := q.Enqueue(app.Name, deliveryID, event, installationID, body)
+			if err == queue.ErrDuplicateDelivery {
+				return nil, http.StatusOK, fmt.Sprintf("Delivery %q has already been received", deliveryID)
+			} else if err != nil {
+				return nil, http.StatusInternalServerError, fmt.Sprintf("Failed to enqueue job: %v", err)
+			}
+			return job, http.StatusAccepted, http.StatusText(http.StatusAccepted)
+		}
+
+		switch event {
+		case "installation":
+			var payload github.InstallationEvent
+			err = json.Unmarshal(body, &payload)
+			if err != nil {
+				return http.StatusBadRequest, fmt.Sprintf("Failed to decode payload: %v", err)
+			}
+			if payload.Installation == nil || payload.Installation.ID == nil {
+				return http.StatusBadRequest, "No installation or installation ID"
+			}
+
+			switch payload.GetAction() {
+			case "deleted", "suspend":
+				// Access tokens of the installation are revoked by GitHub.
+				app.tokens.Invalidate(*payload.Installation.ID)
+				log.Trace("Invalidated access token of installation %d", *payload.Installation.ID)
+				return http.StatusOK, "Access token of the installation has been invalidated"
+			}
+			return http.StatusOK, fmt.Sprintf("Event %q with action %q has been received but nothing to do", event, payload.GetAction())
+
+		case "pull_request":
+			var payload github.PullRequestEvent
+			err = json.Unmarshal(body, &payload)
+			if err != nil {
+				return http.StatusBadRequest, fmt.Sprintf("Failed to decode payload: %v", err)
+			}
+			if payload.Installation == nil || payload.Installation.ID == nil {
+				return http.StatusBadRequest, "No installation or installation ID"
+			} else if payload.Action == nil {
+				return http.StatusBadRequest, "No action"
+			}
+
+			// NOTE: Draft pull requests are skipped by workers unless the repository
+			// opts in, which is only known after loading its configuration file.
+			switch *payload.Action {
+			case "opened", "ready_for_review", "synchronize", "reopened":
+			default:
+				return http.StatusOK, fmt.Sprintf("Event %q with action %q has been received but nothing to do", event, *payload.Action)
+			}
+
+			job, status, message := enqueue(*payload.Installation.ID)
+			if job == nil {
+				return status, message
+			}
+			log.Trace("Enqueued job %s for pull request %s", job.ID, payload.GetPullRequest().GetHTMLURL())
+
+			// Cancel the in-flight run of the same pull request as soon as possible
+			// to free up its worker, rather than waiting for the new job to start.
+			runs.supersede(pullRequestKey(&payload), job.ID)
+			return status, message
+
+		case "check_run":
+			var payload github.CheckRunEvent
+			err = json.Unmarshal(body, &payload)
+			if err != nil {
+				return http.StatusBadRequest, fmt.Sprintf("Failed to decode payload: %v", err)
+			}
+			if payload.Installation == nil || payload.Installation.ID == nil {
+				return http.StatusBadRequest, "No installation or installation ID"
+			}
+
+			if payload.GetCheckRun().GetApp().GetID() != app.AppID {
+				return http.StatusOK, "Skip check run of other apps"
+			} else if !isCheckRunRerunRequested(&payload) {
+				return http.StatusOK, fmt.Sprintf("Event %q with action %q has been received but nothing to do", event, payload.GetAction())
+			}
+
+			job, status, message := enqueue(*payload.Installation.ID)
+			if job == nil {
+				return status, message
+			}
+			log.Trace("Enqueued job %s for check run %s", job.ID, payload.GetCheckRun().GetHTMLURL())
+			return status, message
+
+		case "check_suite":
+			var payload github.CheckSuiteEvent
+			err = json.Unmarshal(body, &payload)
+			if err != nil {
+				return http.StatusBadRequest, fmt.Sprintf("Failed to decode payload: %v", err)
+			}
+			if payload.Installation == nil || payload.Installation.ID == nil {
+				return http.StatusBadRequest, "No installation or installation ID"
+			}
+
+			if payload.GetCheckSuite().GetApp().GetID() != app.AppID {
+				return http.StatusOK, "Skip check suite of other apps"
+			} else if payload.GetAction() != "rerequested" {
+				return http.StatusOK, fmt.Sprintf("Event %q with action %q has been received but nothing to do", event, payload.GetAction())
+			}
+
+			job, status, message := enqueue(*payload.Installation.ID)
+			if job == nil {
+				return status, message
+			}
+			log.Trace("Enqueued job %s for check suite of commit %s", job.ID, payload.GetCheckSuite().GetHeadSHA())
+			return status, message
+
+		case "issue_comment":
+			var payload github.IssueCommentEvent
+			err = json.Unmarshal(body, &payload)
+			if err != nil {
+				return http.StatusBadRequest, fmt.Sprintf("Failed to decode payload: %v", err)
+			}
+			if payload.Installation == nil || payload.Installation.ID == nil {
+				return http.StatusBadRequest, "No installation or installation ID"
+			}
+
+			if payload.GetAction() != "created" {
+				return http.StatusOK, fmt.Sprintf("Event %q with action %q has been received but nothing to do", event, payload.GetAction())
+			} else if payload.GetIssue().PullRequestLinks == nil {
+				return http.StatusOK, "Skip comment on issue"
+			} else if payload.GetComment().GetUser().GetType() == "Bot" {
+				return http.StatusOK, "Skip comment by bot"
+			} else if _, ok := parseSlashCommand(payload.GetComment().GetBody()); !ok {
+				return http.StatusOK, "Skip comment without command"
+			}
+
+			job, status, message := enqueue(*payload.Installation.ID)
+			if job == nil {
+				return status, message
+			}
+			log.Trace("Enqueued job %s for comment %s", job.ID, payload.GetComment().GetHTMLURL())
+			return status, message
+		}
+		return http.StatusOK, fmt.Sprintf("Event %q has been received but nothing to do", event)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flamego/flamego"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/codenotify/codenotify.run/internal/conf"
+	"github.com/codenotify/codenotify.run/internal/queue"
+)
+
+func TestHandleWebhook_Installation(t *testing.T) {
+	q, err := queue.Open(filepath.Join(t.TempDir(), "queue.db"), time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = q.Close() })
+
+	var created int
+	tokens := newTokenCache(func(context.Context, int64) (string, time.Time, error) {
+		created++
+		return "token", time.Now().Add(time.Hour), nil
+	})
+	_, err = tokens.Get(context.Background(), 1)
+	require.NoError(t, err)
+
+	apps := githubApps{{GitHubApp: &conf.GitHubApp{Name: conf.DefaultGitHubApp}, tokens: tokens}}
+	f := flamego.New()
+	f.Post("/-/webhook", handleWebhook(apps, q, newRunRegistry()))
+
+	tests := []struct {
+		action      string
+		wantCreated int
+	}{
+		{action: "new_permissions_accepted", wantCreated: 1},
+		{action: "suspend", wantCreated: 2},
+		{action: "deleted", wantCreated: 3},
+	}
+	for _, test := range tests {
+		t.Run(test.action, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodPost, "/-/webhook", strings.NewReader(`{"action":"`+test.action+`","installation":{"id":1}}`))
+			require.NoError(t, err)
+			req.Header.Set("X-GitHub-Event", "installation")
+			f.ServeHTTP(resp, req)
+			assert.Equal(t, http.StatusOK, resp.Code)
+
+			_, err = tokens.Get(context.Background(), 1)
+			require.NoError(t, err)
+			assert.Equal(t, test.wantCreated, created)
+		})
+	}
+}
+
+func TestHandleWebhook_DuplicateDelivery(t *testing.T) {
+	q, err := queue.Open(filepath.Join(t.TempDir(), "queue.db"), time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = q.Close() })
+
+	apps := newGitHubApps(&conf.Config{GitHubApps: []*conf.GitHubApp{{Name: conf.DefaultGitHubApp}}})
+	f := flamego.New()
+	f.Post("/-/webhook", handleWebhook(apps, q, newRunRegistry()))
+
+	deliver := func(t *testing.T) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodPost, "/-/webhook", strings.NewReader(`{"action":"opened","installation":{"id":1},"pull_request":{"number":1}}`))
+		require.NoError(t, err)
+		req.Header.Set("X-GitHub-Event", "pull_request")
+		req.Header.Set("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+		f.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := deliver(t)
+	assert.Equal(t, http.StatusAccepted, resp.Code, resp.Body.String())
+	resp = deliver(t)
+	assert.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	assert.Contains(t, resp.Body.String(), "has already been received")
+
+	job, err := q.Claim(func(int64) bool { return true })
+	require.NoError(t, err)
+	require.NotNil(t, job)
+	require.NoError(t, q.Complete(job.ID))
+	job, err = q.Claim(func(int64) bool { return true })
+	require.NoError(t, err)
+	assert.Nil(t, job, "the redelivery is not enqueued")
+}
+
+func TestHandleWebhook_MultipleApps(t *testing.T) {
+	q, err := queue.Open(filepath.Join(t.TempDir(), "queue.db"), time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = q.Close() })
+
+	apps := newGitHubApps(
+		&conf.Config{
+			GitHubApps: []*conf.GitHubApp{
+				{Name: conf.DefaultGitHubApp, AppID: 1, WebhookSecret: "public-secret"},
+				{Name: "internal", AppID: 2, WebhookSecret: "internal-secret", WebhookPath: "/-/webhook/internal"},
+			},
+		},
+	)
+	webhook := handleWebhook(apps, q, newRunRegistry())
+	f := flamego.New()
+	f.Post("/-/webhook", webhook)
+	f.Post("/-/webhook/internal", webhook)
+
+	tests := []struct {
+		name     string
+		path     string
+		targetID string
+		secret   string
+		wantCode int
+		wantApp  string
+	}{
+		{
+			name:     "default app",
+			path:     "/-/webhook",
+			secret:   "public-secret",
+			wantCode: http.StatusAccepted,
+			wantApp:  conf.DefaultGitHubApp,
+		},
+		{
+			name:     "by webhook path",
+			path:     "/-/webhook/internal",
+			secret:   "internal-secret",
+			wantCode: http.StatusAccepted,
+			wantApp:  "internal",
+		},
+		{
+			name:     "by app ID",
+			path:     "/-/webhook",
+			targetID: "2",
+			secret:   "internal-secret",
+			wantCode: http.StatusAccepted,
+			wantApp:  "internal",
+		},
+		{
+			name:     "secret of another app",
+			path:     "/-/webhook",
+			targetID: "2",
+			secret:   "public-secret",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := `{"action":"opened","installation":{"id":1},"pull_request":{"number":1}}`
+			m := hmac.New(sha256.New, []byte(test.secret))
+			_, _ = m.Write([]byte(body))
+
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodPost, test.path, strings.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("X-GitHub-Event", "pull_request")
+			req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(m.Sum(nil)))
+			if test.targetID != "" {
+				req.Header.Set("X-GitHub-Hook-Installation-Target-Type", "integration")
+				req.Header.Set("X-GitHub-Hook-Installation-Target-ID", test.targetID)
+			}
+			f.ServeHTTP(resp, req)
+			require.Equal(t, test.wantCode, resp.Code, resp.Body.String())
+			if test.wantApp == "" {
+				return
+			}
+
+			job, err := q.Claim(func(int64) bool { return true })
+			require.NoError(t, err)
+			require.NotNil(t, job)
+			assert.Equal(t, test.wantApp, job.App)
+			require.NoError(t, q.Complete(job.ID))
+		})
+	}
+}
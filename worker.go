@@ -0,0 +1,315 @@
+// Copyright 2022 Unknwon. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+	"github.com/pkg/errors"
+	log "unknwon.dev/clog/v2"
+
+	"github.com/codenotify/codenotify.run/internal/conf"
+	"github.com/codenotify/codenotify.run/internal/queue"
+	"github.com/codenotify/codenotify.run/internal/rundb"
+	"github.com/codenotify/codenotify.run/internal/runlog"
+)
+
+// maxJobAttempts is the maximum number of times a job can be claimed before it
+// is given up, which prevents a job that crashes the process from being
+// resumed forever.
+const maxJobAttempts = 3
+
+// workerPool is a bounded pool of workers that process jobs from the queue,
+// with at most a given number of concurrent jobs per installation.
+type workerPool struct {
+	config *conf.Config
+	apps   githubApps
+	queue  *queue.Queue
+	runs   *runRegistry
+	store  runlog.Store
+	db     *rundb.DB
+	wake   chan struct{}
+
+	mu      sync.Mutex
+	running map[int64]int // Installation ID -> number of running jobs
+}
+
+// startWorkers starts a pool of workers that process jobs from the queue.
+func startWorkers(ctx context.Context, config *conf.Config, apps githubApps, q *queue.Queue, runs *runRegistry, store runlog.Store, db *rundb.DB) {
+	p := &workerPool{
+		config:  config,
+		apps:    apps,
+		queue:   q,
+		runs:    runs,
+		store:   store,
+		db:      db,
+		wake:    make(chan struct{}, config.Queue.Concurrency),
+		running: make(map[int64]int),
+	}
+	for i := 0; i < config.Queue.Concurrency; i++ {
+		go p.run(ctx)
+	}
+}
+
+// claim claims the next job whose installation has not reached the
+// per-installation concurrency limit.
+func (p *workerPool) claim() (*queue.Job, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	limit := p.config.Queue.InstallationConcurrency
+	job, err := p.queue.Claim(func(installationID int64) bool {
+		return limit <= 0 || p.running[installationID] < limit
+	})
+	if err != nil || job == nil {
+		return nil, err
+	}
+	p.running[job.InstallationID]++
+	return job, nil
+}
+
+// release marks the job as no longer running and wakes up an idle worker,
+// which may now be able to claim a job of the same installation.
+func (p *workerPool) release(job *queue.Job) {
+	p.mu.Lock()
+	p.running[job.InstallationID]--
+	if p.running[job.InstallationID] <= 0 {
+		delete(p.running, job.InstallationID)
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *workerPool) run(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		job, err := p.claim()
+		if err != nil {
+			log.Error("Failed to claim job: %v", err)
+		} else if job != nil {
+			if job.Attempts > maxJobAttempts {
+				log.Warn("Giving up job %s after %d attempts", job.ID, job.Attempts-1)
+			} else if err = processJob(ctx, p.config, p.apps, p.runs, p.store, p.db, job); err != nil {
+				if until, ok := rateLimitedUntil(err); ok {
+					// Retry the job after the rate limits of the installation reset,
+					// meanwhile other jobs of the installation are held back as well.
+					log.Warn("Requeued job %s until %s because of rate limits: %v", job.ID, until.Format(time.RFC3339), err)
+					if err = p.queue.Requeue(job.ID, until); err == nil {
+						p.release(job)
+						continue
+					}
+					log.Error("Failed to requeue job %s: %v", job.ID, err)
+				} else {
+					log.Error("Failed to process job %s: %v", job.ID, err)
+				}
+			}
+
+			if err = p.queue.Complete(job.ID); err != nil {
+				log.Error("Failed to complete job %s: %v", job.ID, err)
+			}
+			p.release(job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.queue.Notify():
+		case <-p.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func processJob(ctx context.Context, config *conf.Config, apps githubApps, runs *runRegistry, store runlog.Store, db *rundb.DB, job *queue.Job) error {
+	app := apps.get(job.App)
+	if app == nil {
+		return errors.Errorf("unknown GitHub App %q", job.App)
+	}
+
+	switch job.Event {
+	case "pull_request":
+		var payload github.PullRequestEvent
+		err := json.Unmarshal(job.Payload, &payload)
+		if err != nil {
+			return errors.Wrap(err, "decode payload")
+		}
+		return processPullRequest(ctx, config, app, runs, store, db, job, &payload)
+
+	case "check_run":
+		var payload github.CheckRunEvent
+		err := json.Unmarshal(job.Payload, &payload)
+		if err != nil {
+			return errors.Wrap(err, "decode payload")
+		}
+
+		// The external ID of check runs created by us is the pull request number,
+		// which is the most accurate reference to the pull request when available.
+		var numbers []int
+		if number, err := strconv.Atoi(payload.GetCheckRun().GetExternalID()); err == nil {
+			numbers = append(numbers, number)
+		} else {
+			numbers = pullRequestNumbers(payload.GetCheckRun().PullRequests)
+		}
+		return processRerequested(ctx, config, app, runs, store, db, job, payload.Installation, payload.Repo, numbers, payload.GetCheckRun().GetHeadSHA())
+
+	case "check_suite":
+		var payload github.CheckSuiteEvent
+		err := json.Unmarshal(job.Payload, &payload)
+		if err != nil {
+			return errors.Wrap(err, "decode payload")
+		}
+
+		numbers := pullRequestNumbers(payload.GetCheckSuite().PullRequests)
+		return processRerequested(ctx, config, app, runs, store, db, job, payload.Installation, payload.Repo, numbers, payload.GetCheckSuite().GetHeadSHA())
+
+	case "issue_comment":
+		var payload github.IssueCommentEvent
+		err := json.Unmarshal(job.Payload, &payload)
+		if err != nil {
+			return errors.Wrap(err, "decode payload")
+		}
+		return processIssueComment(ctx, config, app, runs, store, db, job, &payload)
+
+	case jobEventAdminAPI:
+		var payload rerunPayload
+		err := json.Unmarshal(job.Payload, &payload)
+		if err != nil {
+			return errors.Wrap(err, "decode payload")
+		}
+		return processRerequested(ctx, config, app, runs, store, db, job, payload.Installation, payload.Repo, []int{payload.Number}, "")
+	}
+	return errors.Errorf("unexpected event %q", job.Event)
+}
+
+func pullRequestNumbers(prs []*github.PullRequest) []int {
+	numbers := make([]int, 0, len(prs))
+	for _, pr := range prs {
+		numbers = append(numbers, pr.GetNumber())
+	}
+	return numbers
+}
+
+// processRerequested runs Codenotify again for the given pull requests. When no
+// pull request is given (e.g. the pull request is coming from a fork
+// repository), open pull requests associated with the head commit are looked
+// up instead.
+func processRerequested(ctx context.Context, config *conf.Config, app *githubApp, runs *runRegistry, store runlog.Store, db *rundb.DB, job *queue.Job, installation *github.Installation, repo *github.Repository, numbers []int, headSHA string) error {
+	client, _, err := newGitHubClient(ctx, app, installation.GetID())
+	if err != nil {
+		return errors.Wrap(err, "create GitHub client")
+	}
+
+	owner := repo.GetOwner().GetLogin()
+	if len(numbers) == 0 {
+		prs, _, err := client.PullRequests.ListPullRequestsWithCommit(ctx, owner, repo.GetName(), headSHA, nil)
+		if err != nil {
+			return errors.Wrapf(err, "list pull requests with commit %q", headSHA)
+		}
+		for _, pr := range prs {
+			if pr.GetState() == "open" {
+				numbers = append(numbers, pr.GetNumber())
+			}
+		}
+	}
+	if len(numbers) == 0 {
+		log.Info("Skipped job %s with no open pull request associated with commit %s", job.ID, headSHA)
+		return nil
+	}
+
+	for _, number := range numbers {
+		pr, _, err := client.PullRequests.Get(ctx, owner, repo.GetName(), number)
+		if err != nil {
+			return errors.Wrapf(err, "get pull request #%d", number)
+		}
+
+		err = processPullRequest(
+			ctx,
+			config,
+			app,
+			runs,
+			store,
+			db,
+			job,
+			&github.PullRequestEvent{
+				Action:       github.String("synchronize"),
+				Number:       pr.Number,
+				PullRequest:  pr,
+				Repo:         repo,
+				Installation: installation,
+			},
+		)
+		if err != nil {
+			return errors.Wrapf(err, "process pull request #%d", number)
+		}
+	}
+	return nil
+}
+
+// processPullRequest runs Codenotify for the pull request of the payload.
+func processPullRequest(ctx context.Context, config *conf.Config, app *githubApp, runs *runRegistry, store runlog.Store, db *rundb.DB, job *queue.Job, payload *github.PullRequestEvent) error {
+	ctx, done, ok := runs.start(ctx, pullRequestKey(payload), job.ID, payload.GetPullRequest().GetHead().GetSHA())
+	defer done()
+	if !ok {
+		log.Info("Skipped job %s for pull request %s that has been superseded by a newer job", job.ID, payload.GetPullRequest().GetHTMLURL())
+		return nil
+	}
+
+	switch payload.GetAction() {
+	case "opened":
+		return reportCommitStatus(ctx, config, app, runs, store, db, job, payload, handlePullRequestOpen)
+	case "ready_for_review", "synchronize", "reopened":
+		// NOTE: Draft pull requests may have been reported when the repository
+		// opts in, thus the existing report comment is edited (unless muted)
+		// rather than creating another one.
+		return reportCommitStatus(ctx, config, app, runs, store, db, job, payload, handlePullRequestSynchronize)
+	default:
+		return errors.Errorf("unexpected action %q", payload.GetAction())
+	}
+}
+
+// jobTrigger returns the event and the action of the webhook delivery of the
+// job, e.g. "check_run.rerequested", which describes what triggered the run.
+func jobTrigger(job *queue.Job) string {
+	var payload struct {
+		Action string `json:"action"`
+	}
+	_ = json.Unmarshal(job.Payload, &payload)
+	if payload.Action == "" {
+		return job.Event
+	}
+	return job.Event + "." + payload.Action
+}
+
+// purgeExpiredDeliveries periodically removes expired delivery IDs from the
+// queue.
+func purgeExpiredDeliveries(ctx context.Context, q *queue.Queue) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		purged, err := q.PurgeExpiredDeliveries()
+		if err != nil {
+			log.Error("Failed to purge expired deliveries: %v", err)
+		} else if purged > 0 {
+			log.Trace("Purged %d expired deliveries", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}